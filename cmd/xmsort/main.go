@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -15,101 +16,388 @@ import (
 	"github.com/joeymeijers/xmsort/internal/utils"
 )
 
-const MAX_MERGE_BATCH = 100
-
 func main() {
 
 	if len(os.Args) == 1 {
 		config.PrintXMSortUsage()
 		os.Exit(1)
 	}
+	os.Exit(run())
+}
+
+// run executes the job and returns the process exit code. It is split from
+// main so deferred cleanup still runs before exiting.
+func run() int {
 
-	utils.SetupLogging()
 	cfg := config.ParseXSSortParams(strings.Join(os.Args[1:], " "))
+	if cfg.OutputFile == utils.STDIO {
+		// Keep stdout clean for the sorted records
+		utils.SetConsole(os.Stderr)
+	}
+	utils.SetupLogging()
 
-	inputFile := cfg.InputFile
 	outputFile := cfg.OutputFile
-	sortKeys := cfg.SortKeys
-	delimiter := cfg.Delimiter
-	truncateSpaces := cfg.TruncateSpaces
-	removeDuplicates := cfg.RemoveDuplicates
-	emptyNumbers := cfg.EmptyNumbers
-	recordType := strings.ToUpper(cfg.RecordType)
-	recordLength := cfg.RecordLength
+	opts := sorting.Options{
+		SortKeys:         cfg.SortKeys,
+		Delimiter:        cfg.Delimiter,
+		TruncateSpaces:   cfg.TruncateSpaces,
+		RemoveDuplicates: cfg.RemoveDuplicates,
+		EmptyNumbers:     cfg.EmptyNumbers,
+		RecordLength:     cfg.RecordLength,
+		RecordType:       strings.ToUpper(cfg.RecordType),
+		Stable:           cfg.Stable,
+		DedupByKey:       cfg.DedupByKey,
+		KeepLast:         cfg.KeepLast,
+		SkipRecords:      cfg.SkipRecords,
+		StopAfter:        cfg.StopAfter,
+		Limit:            cfg.Limit,
+		Filter:           cfg.Filter,
+		Inrec:            cfg.Inrec,
+		Outrec:           cfg.Outrec,
+		Sum:              cfg.Sum,
+		SeqNum:           cfg.SeqNum,
+	}
 
-	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
-		utils.LogError("Input file does not exists: %s", inputFile)
-		return
+	inputFiles, err := utils.ExpandInputFiles(cfg.InputFiles)
+	if err != nil {
+		utils.LogError("%v", err)
+		return 1
+	}
+	for _, inputFile := range inputFiles {
+		if inputFile == utils.STDIO {
+			continue
+		}
+		if _, err := os.Stat(inputFile); os.IsNotExist(err) {
+			utils.LogError("Input file does not exists: %s", inputFile)
+			return 1
+		}
 	}
 
 	start := time.Now()
 	utils.LogInfo("Go external sort")
 	utils.LogInfo("Start: %v", start)
-	utils.LogInfo("Input file: %v", cfg.InputFile)
+	utils.LogInfo("Input files: %v", inputFiles)
 	utils.LogInfo("Output file: %v", cfg.OutputFile)
 	utils.LogInfo("Sort keys: %v", cfg.SortKeys)
-	utils.LogInfo("Delimiter: %v", delimiter)
+	utils.LogInfo("Delimiter: %v", cfg.Delimiter)
 	utils.LogInfo("Record type: %v", cfg.RecordType)
 	utils.LogInfo("Record length: %v", cfg.RecordLength)
 	utils.LogInfo("Truncate spaces: %v", cfg.TruncateSpaces)
-	utils.LogInfo("Remove duplicates: %v", cfg.RemoveDuplicates)
+	utils.LogInfo("Remove duplicates: %v (by key: %v, keep last: %v)", cfg.RemoveDuplicates, cfg.DedupByKey, cfg.KeepLast)
+	utils.LogInfo("Duplicates file: %v", cfg.XsumFile)
 	utils.LogInfo("Empty numbers: %v", cfg.EmptyNumbers)
-	utils.LogInfo("Memory: %v", cfg.Memory)
 	utils.LogInfo("Temp dir (config): %v", cfg.TempDir)
+	utils.LogInfo("Stable (equals): %v", cfg.Stable)
+	utils.LogInfo("Skip records: %d, stop after: %d, limit: %d", cfg.SkipRecords, cfg.StopAfter, cfg.Limit)
+	utils.LogInfo("Include: %v, omit: %v", cfg.Include, cfg.Omit)
+	if cfg.Sum != nil {
+		utils.LogInfo("Sum fields: %v (fail on overflow: %v)", cfg.Sum.Fields, cfg.Sum.FailOnOverflow)
+	}
+	utils.LogInfo("Merge only: %v (verify order: %v)", cfg.MergeOnly, cfg.VerifyOrder)
+	if cfg.Join {
+		utils.LogInfo("Join: %v with %v (F1 keys: %v, F2 keys: %v, sorted: %v)",
+			cfg.JoinType, cfg.JoinFiles, cfg.JoinKeys1, cfg.JoinKeys2, cfg.JoinSorted)
+	}
 
-	averageLineSize := utils.EstimateAverageLineSize(inputFile)
-	utils.LogInfo("Estimated average line size: %v", averageLineSize)
-	chunkSize := utils.CalculateChunkSize(averageLineSize)
-	utils.LogInfo("Calculated chunk size: %d", chunkSize)
+	if cfg.Memory > 0 {
+		// The whole heap stays under MEM=: the garbage collector works
+		// harder rather than let it grow past the limit
+		debug.SetMemoryLimit(cfg.Memory)
+		utils.LogInfo("Memory limit: %d bytes", cfg.Memory)
+	}
+	if cfg.Memory > 0 && sortMemory(cfg.Memory) < merging.MinMemory {
+		utils.LogError("MEM=%d is too small: at least %d bytes are needed to merge",
+			cfg.Memory, (merging.MinMemory+2)/3*4)
+		return 1
+	}
+	opts.Memory = utils.NewMemoryBudget(sortMemory(cfg.Memory))
+	utils.LogInfo("Memory for chunks and merges: %.2f MB (chunks of %.2f MB)",
+		float64(opts.Memory.Total())/1e6, float64(opts.Memory.ChunkBytes())/1e6)
+
+	if cfg.CheckOrder {
+		return checkOrder(inputFiles, opts, cfg.CountViolations)
+	}
+	if cfg.SetOperation {
+		return setOperation(cfg, inputFiles, opts)
+	}
 
 	tempDir, err := os.MkdirTemp("", "sort_chunks")
 	if err != nil {
 		utils.LogError("Error creating temp directory: %v", err)
-		return
+		return 1
 	}
 	defer utils.SafeRemoveAll(tempDir)
 	utils.LogInfo("Temporary directory: %s", tempDir)
 
-	chunkFiles, err := sorting.SplitFileAndSort(
-		inputFile,
-		chunkSize,
-		sortKeys,
-		tempDir,
-		delimiter,
-		truncateSpaces,
-		removeDuplicates,
-		emptyNumbers,
-		recordLength,
-		recordType,
-	)
+	if cfg.Join {
+		return joinFiles(cfg, inputFiles, opts, tempDir)
+	}
+
+	if cfg.XsumFile != "" {
+		discarded, err := sorting.CreateDiscardLog(cfg.XsumFile, cfg.XsumLineNumbers)
+		if err != nil {
+			utils.LogError("Error creating duplicates file: %v", err)
+			return 1
+		}
+		defer func() {
+			if err := discarded.Close(); err != nil {
+				utils.LogError("Error writing duplicates file: %v", err)
+			}
+			utils.LogInfo("Duplicates written to %s: %d", cfg.XsumFile, discarded.Count())
+		}()
+		opts.Discarded = discarded
+	}
+
+	// In merge-only mode the inputs are the runs; they are kept, not removed
+	batchMode := merging.MergeMode{RunOutput: true}
+	chunkFiles := inputFiles
+	if cfg.MergeOnly {
+		batchMode.KeepInputs = true
+		batchMode.VerifyOrder = cfg.VerifyOrder
+	} else {
+		var sorted *sorting.Sorted
+		chunkFiles, sorted, err = sorting.SortFile(inputFiles, 0, tempDir, opts)
+		if err != nil {
+			utils.LogError("Error splitting file: %v", err)
+			return 1
+		}
+		if sorted != nil {
+			// The input fit in one chunk: no chunk files and no merge
+			utils.LogInfo("Sorted %d records in memory", sorted.Len())
+			if err := merging.WriteSorted(outputFile, sorted, opts); err != nil {
+				utils.LogError("Error writing output: %v", err)
+				return 1
+			}
+			utils.LogInfo("Sorting completed in %v\n", time.Since(start))
+			return 0
+		}
+		utils.LogInfo("Created %d chunk files", len(chunkFiles))
+	}
+
+	planner := newMergePlanner(opts.Memory)
+	intermediateFiles, err := mergePasses(chunkFiles, tempDir, opts, batchMode, planner)
+	if err != nil {
+		utils.LogError("Error in batch merge: %v", err)
+		return 1
+	}
+
+	utils.LogInfo("Merging final batch (%d files)", len(intermediateFiles))
+	if cfg.MergeOnly && len(intermediateFiles) == len(chunkFiles) {
+		// No pass ran: the final merge reads the inputs, which are kept
+		err = merging.Merge(outputFile, intermediateFiles, opts, merging.MergeMode{
+			KeepInputs:  true,
+			VerifyOrder: cfg.VerifyOrder,
+		})
+	} else {
+		workers := planner.FinalWorkers(len(intermediateFiles))
+		err = merging.MergeParallel(outputFile, intermediateFiles, opts, workers, tempDir)
+	}
+	if err != nil {
+		utils.LogError("Error merging intermediate files: %v", err)
+		return 1
+	}
+
+	utils.LogInfo("Sorting completed in %v\n", time.Since(start))
+	return 0
+}
+
+// joinFiles sorts the two join files on their own keys, unless they are
+// already sorted, and merge-joins them into the output.
+func joinFiles(cfg config.Config, inputFiles []string, opts sorting.Options, tempDir string) int {
+	f2Files, err := utils.ExpandInputFiles(cfg.JoinFiles)
 	if err != nil {
-		utils.LogError("Error splitting file: %v", err)
-		return
+		utils.LogError("%v", err)
+		return 1
 	}
-	utils.LogInfo("Created %d chunk files", len(chunkFiles))
 
-	totalBatches := (len(chunkFiles) + MAX_MERGE_BATCH - 1) / MAX_MERGE_BATCH
+	// Each file keeps the record layout of the job but sorts on its join
+	// keys, stably so equal keys pair up in input order
+	runs := make([]string, 2)
+	for i, files := range [][]string{inputFiles, f2Files} {
+		sideOpts := sorting.Options{
+			SortKeys:       cfg.JoinKeys1,
+			Delimiter:      opts.Delimiter,
+			TruncateSpaces: opts.TruncateSpaces,
+			EmptyNumbers:   opts.EmptyNumbers,
+			RecordLength:   opts.RecordLength,
+			RecordType:     opts.RecordType,
+			Stable:         true,
+			Memory:         opts.Memory,
+		}
+		if i == 1 {
+			sideOpts.SortKeys = cfg.JoinKeys2
+		}
+		name := fmt.Sprintf("f%d", i+1)
+		if runs[i], err = sortedRun(files, sideOpts, cfg.JoinSorted, tempDir, name); err != nil {
+			utils.LogError("Error sorting %s: %v", strings.ToUpper(name), err)
+			return 1
+		}
+	}
 
+	stats, err := merging.Join(cfg.OutputFile, runs[0], runs[1], merging.JoinSpec{
+		Type:           cfg.JoinType,
+		Keys1:          cfg.JoinKeys1,
+		Keys2:          cfg.JoinKeys2,
+		Delimiter:      opts.Delimiter,
+		TruncateSpaces: opts.TruncateSpaces,
+		EmptyNumbers:   opts.EmptyNumbers,
+		RecordType:     opts.RecordType,
+		RecordLength:   opts.RecordLength,
+		Reformat:       cfg.JoinReformat,
+		Unpaired1:      cfg.Unpaired1,
+		Unpaired2:      cfg.Unpaired2,
+	})
+	if err != nil {
+		utils.LogError("Error joining files: %v", err)
+		return 1
+	}
+	utils.LogInfo("Joined records: %d, unpaired F1: %d, unpaired F2: %d", stats.Paired, stats.Unpaired1, stats.Unpaired2)
+	return 0
+}
+
+// sortedRun returns one file holding the records of files in key order. A
+// single sorted file is used as it is; several are merged into a run.
+func sortedRun(files []string, opts sorting.Options, sorted bool, tempDir, name string) (string, error) {
+	if sorted && len(files) == 1 {
+		return files[0], nil
+	}
+	dir, err := os.MkdirTemp(tempDir, name)
+	if err != nil {
+		return "", err
+	}
+	run := filepath.Join(dir, name+".run")
+	if sorted {
+		mode := merging.MergeMode{KeepInputs: true, VerifyOrder: true, RunOutput: true}
+		return run, merging.Merge(run, files, opts, mode)
+	}
+
+	chunkFiles, err := sorting.SplitFileAndSort(files, 0, dir, opts)
+	if err != nil {
+		return "", err
+	}
+	intermediateFiles, err := mergePasses(chunkFiles, dir, opts, merging.MergeMode{RunOutput: true}, newMergePlanner(opts.Memory))
+	if err != nil {
+		return "", err
+	}
+	return run, merging.Merge(run, intermediateFiles, opts, merging.MergeMode{RunOutput: true})
+}
+
+// setOperation combines inputs that are already sorted on the job's keys.
+func setOperation(cfg config.Config, inputFiles []string, opts sorting.Options) int {
+	if len(inputFiles) < 2 {
+		utils.LogError("SET=%v needs at least two input files", cfg.SetOp)
+		return 1
+	}
+	written, err := merging.SetOperation(cfg.OutputFile, inputFiles, opts, cfg.SetOp, cfg.SetCounts)
+	if err != nil {
+		utils.LogError("Error in SET=%v: %v", cfg.SetOp, err)
+		return 1
+	}
+	utils.LogInfo("SET=%v wrote %d records", cfg.SetOp, written)
+	return 0
+}
+
+// checkOrder reports whether the inputs are sorted without writing output.
+// It returns exit code 0 when they are and 1 when they are not.
+func checkOrder(inputFiles []string, opts sorting.Options, countAll bool) int {
+	result, err := sorting.CheckSorted(inputFiles, opts, countAll)
+	if err != nil {
+		utils.LogError("Error checking order: %v", err)
+		return 1
+	}
+	if result.Sorted() {
+		utils.LogInfo("Input is sorted (%d records)", result.Records)
+		return 0
+	}
+	utils.LogError("Input is not sorted: %s line %d sorts before %s line %d",
+		result.File, result.Line, result.PreviousFile, result.PreviousLine)
+	utils.LogError("  %s line %d: %s", result.PreviousFile, result.PreviousLine, result.Previous)
+	utils.LogError("  %s line %d: %s", result.File, result.Line, result.Record)
+	if countAll {
+		utils.LogError("Records out of order: %d of %d", result.Violations, result.Records)
+	}
+	return 1
+}
+
+// minSortMemory is the budget when the available memory cannot be read.
+const minSortMemory = 64 << 20
+
+// sortMemory returns the bytes chunks and merge buffers may hold together.
+// A quarter of MEM= is left to the runtime and the rest of the program;
+// without MEM= the sort takes a share of the available memory.
+func sortMemory(limit int64) int64 {
+	if limit > 0 {
+		return limit / 4 * 3
+	}
+	return max(int64(utils.ReservedMemory()), minSortMemory)
+}
+
+// newMergePlanner plans merges within the open file limit and the memory
+// budget of the sort.
+func newMergePlanner(memory *utils.MemoryBudget) merging.MergePlanner {
+	return merging.MergePlanner{
+		MaxOpenFiles: utils.GetMaxOpenFiles(),
+		Memory:       memory.Total(),
+		Workers:      runtime.NumCPU(),
+	}
+}
+
+// mergePasses merges the runs in as many passes as the planner needs and
+// returns the runs for the final merge in input order. The first pass reads
+// the runs as directed by mode; later passes read its own intermediates.
+func mergePasses(
+	runs []string,
+	tempDir string,
+	opts sorting.Options,
+	mode merging.MergeMode,
+	planner merging.MergePlanner,
+) ([]string, error) {
+	utils.LogInfo("Merge fan-in: %d runs (open file limit %d)", planner.FanIn(1), planner.MaxOpenFiles)
+	for pass := 1; !planner.Final(len(runs)); pass++ {
+		groups, parallel := planner.Pass(len(runs))
+		utils.LogInfo("Merge pass %d: %d runs in %d merges, %d at a time", pass, len(runs), len(groups), parallel)
+		var err error
+		if runs, err = mergePass(runs, groups, parallel, tempDir, pass, opts, mode); err != nil {
+			return nil, err
+		}
+		mode = merging.MergeMode{RunOutput: true}
+	}
+	return runs, nil
+}
+
+// mergePass merges each group of consecutive runs into an intermediate run,
+// parallel merges at a time, and returns the intermediates in run order.
+func mergePass(
+	runs []string,
+	groups []int,
+	parallel int,
+	tempDir string,
+	pass int,
+	opts sorting.Options,
+	mode merging.MergeMode,
+) ([]string, error) {
 	var (
-		intermediateFiles []string
+		// Indexed by group so the next pass sees the intermediates in input order
+		intermediateFiles = make([]string, len(groups))
 		mergeWg           sync.WaitGroup
 		mergeErrOnce      sync.Once
 		mergeErr          error
-		mergeSem          = make(chan struct{}, runtime.NumCPU())
-		intermediateMu    sync.Mutex
+		mergeSem          = make(chan struct{}, parallel)
 	)
+	mode.Parallel = parallel
 
-	for i := 0; i < len(chunkFiles); i += MAX_MERGE_BATCH {
-		end := min(i+MAX_MERGE_BATCH, len(chunkFiles))
+	start := 0
+	for batch, size := range groups {
+		end := start + size
 		mergeWg.Add(1)
 		mergeSem <- struct{}{}
 		go func(i, end, batch int) {
 			defer mergeWg.Done()
 			defer func() { <-mergeSem }()
-			intermediate := filepath.Join(tempDir, fmt.Sprintf("intermediate_%d.txt", batch))
-			tmpFile := filepath.Join(tempDir, fmt.Sprintf("intermediate_%d.tmp", batch))
-			utils.LogInfo("Merging batch %d/%d (%d files)", batch+1, totalBatches, end-i)
-			err := merging.MergeChunks(tmpFile, chunkFiles[i:end], sortKeys, delimiter)
+			intermediate := filepath.Join(tempDir, fmt.Sprintf("intermediate_%d_%d.run", pass, batch))
+			tmpFile := filepath.Join(tempDir, fmt.Sprintf("intermediate_%d_%d.tmp", pass, batch))
+			utils.LogInfo("Merging batch %d/%d (%d files)", batch+1, len(groups), end-i)
+			err := merging.Merge(tmpFile, runs[i:end], opts, mode)
 			if err == nil {
 				if _, statErr := os.Stat(tmpFile); statErr == nil {
 					err = os.Rename(tmpFile, intermediate)
@@ -121,24 +409,14 @@ func main() {
 				mergeErrOnce.Do(func() { mergeErr = err })
 				return
 			}
-			intermediateMu.Lock()
-			intermediateFiles = append(intermediateFiles, intermediate)
-			intermediateMu.Unlock()
-		}(i, end, i/MAX_MERGE_BATCH)
+			intermediateFiles[batch] = intermediate
+		}(start, end, batch)
+		start = end
 	}
 	mergeWg.Wait()
 
 	if mergeErr != nil {
-		utils.LogError("Error in batch merge: %v", mergeErr)
-		return
+		return nil, mergeErr
 	}
-
-	utils.LogInfo("Merging final batch %d/%d (%d files)", totalBatches, totalBatches, len(intermediateFiles))
-	err = merging.MergeChunks(outputFile, intermediateFiles, sortKeys, delimiter)
-	if err != nil {
-		utils.LogError("Error merging intermediate files: %v", err)
-		return
-	}
-
-	utils.LogInfo("Sorting completed in %v\n", time.Since(start))
+	return intermediateFiles, nil
 }
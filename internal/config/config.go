@@ -6,13 +6,16 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/joeymeijers/xmsort/internal/merging"
 	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
 )
 
 var ExitFunc = os.Exit
 
 type Config struct {
 	InputFile     string
+	InputFiles    []string // I=<file>, I=(<file>,<file>,...) or glob patterns
 	OutputFile    string
 	SortKeys      sorting.SortKeySlice
 	FieldSortKeys sorting.FieldKeySlice
@@ -23,23 +26,89 @@ type Config struct {
 	RecordLength     int    // RL=nn
 	RecordType       string // RT={V|F}
 	TruncateSpaces   bool   // TS={Y|N}
-	RemoveDuplicates bool   // RD={Y|N}
+	RemoveDuplicates bool   // RD={Y|N|REC|KEY}
+	DedupByKey       bool   // RD=KEY
+	KeepLast         bool   // KEEP={FIRST|LAST}
+	XsumFile         string // XSUM=<file>
+	XsumLineNumbers  bool   // XSUMLN={Y|N}
 	EmptyNumbers     string // EN={Z|E}
 	TempDir          string // TMP=...
-	Memory           string // MEM=...
+	Memory           int64  // MEM=..., in bytes; 0 sizes memory from the host
+	Stable           bool   // EQUALS={Y|N} or TAG={Y|N}
+	MergeOnly        bool   // MERGE={Y|N}
+	VerifyOrder      bool   // VERIFY={Y|N}
+	CheckOrder       bool   // CHECK={Y|N|ALL}
+	CountViolations  bool   // CHECK=ALL
+	Include          string // INCLUDE=(...)
+	Omit             string // OMIT=(...)
+	Filter           *sorting.Filter
+	Inrec            *sorting.Reformat  // INREC=(...)
+	Outrec           *sorting.Reformat  // OUTREC=(...)
+	Sum              *sorting.SumFields // SUM=(...), SUMOVFL={KEEP|FAIL}
+	SeqNum           *sorting.SeqNum    // SEQ=(pos,len), SEQKEY=(start,len)
+	SkipRecords      int64              // SKIPREC=n
+	StopAfter        int64              // STOPAFT=n
+	Limit            int64              // LIMIT=n
+	Join             bool               // JOIN={INNER|LEFT|RIGHT|FULL}
+	JoinType         merging.JoinType   // the JOIN= type
+	JoinFiles        []string           // F2=<file> or F2=(<f1>,<f2>)
+	JoinKeys1        []sorting.SortKey  // J1=(...), one per key
+	JoinKeys2        []sorting.SortKey  // J2=(...)
+	JoinSorted       bool               // SORTED={Y|N}
+	Unpaired1        string             // UNPAIRED1=<file>
+	Unpaired2        string             // UNPAIRED2=<file>
+	JoinReformat     *sorting.Reformat  // REFORMAT=(...)
+	SetOperation     bool               // SET={UNION|INTERSECT|EXCEPT}
+	SetOp            merging.SetOp      // the SET= operation
+	SetCounts        bool               // SETCOUNT={Y|N}
 }
 
 func PrintXMSortUsage() {
 	fmt.Println("XSSORT parameters:")
-	fmt.Println("  I=<file>      Input file")
-	fmt.Println("  O=<file>      Output file")
+	fmt.Println("  I=<file>      Input file (- for stdin)")
+	fmt.Println("  I=(<f1>,<f2>) Several input files or glob patterns, sorted together")
+	fmt.Println("  O=<file>      Output file (- for stdout)")
 	fmt.Println("  RL=<length>   Record length")
 	fmt.Println("  RT=<V|F>      Record type (Variable/Fixed)")
 	fmt.Println("  TS=<Y|N>      Truncate spaces")
-	fmt.Println("  RD=<Y|N>      Remove duplicates")
+	fmt.Println("  RD=<Y|N|KEY>  Remove duplicate records (Y/REC) or records with equal keys (KEY)")
+	fmt.Println("  KEEP=<F|L>    Keep the FIRST or LAST duplicate in input order")
+	fmt.Println("  XSUM=<file>   Write the removed duplicates to a file")
+	fmt.Println("  XSUMLN=<Y|N>  Prefix removed duplicates with their input record number")
 	fmt.Println("  EN=<Z|E>      Empty numbers (Zero/Error)")
 	fmt.Println("  TMP=<dir>     Temp directory")
-	fmt.Println("  MEM=<size>    Sort memory (e.g. 512M)")
+	fmt.Println("  MEM=<size>    Sort memory limit (e.g. 512M, 4G)")
+	fmt.Println("  EQUALS=<Y|N>  Stable sort: keep equal keys in input order (TAG=Y is an alias)")
+	fmt.Println("  MERGE=<Y|N>   Merge already sorted inputs without sorting them")
+	fmt.Println("  VERIFY=<Y|N>  With MERGE=Y, fail when an input is not sorted")
+	fmt.Println("  CHECK=<Y|ALL> Only check that the input is sorted (ALL counts every violation)")
+	fmt.Println("  SKIPREC=<n>   Skip the first n input records")
+	fmt.Println("  STOPAFT=<n>   Stop reading after n records (after SKIPREC and INCLUDE/OMIT)")
+	fmt.Println("  LIMIT=<n>     Only write the first n sorted records (top-N)")
+	fmt.Println("  INCLUDE=(...) Only sort records matching a condition")
+	fmt.Println("  OMIT=(...)    Drop records matching a condition")
+	fmt.Println("    Condition: start,length,op,constant joined by AND/OR, grouped with (...)")
+	fmt.Println("      op = EQ, NE, GT, GE, LT, LE; constant = 'text' or a number")
+	fmt.Println("    Example: INCLUDE=(0,2,EQ,'01',AND,10,5,GT,100)")
+	fmt.Println("  INREC=(...)   Reformat records before sorting; sort keys refer to the new layout")
+	fmt.Println("  OUTREC=(...)  Reformat the sorted output records")
+	fmt.Println("    Items: start,length[,ZD=n|TXT], 'text', nX (n spaces), LENGTH=n")
+	fmt.Println("      ZD=n writes the number as n zero-padded digits with a leading minus, not zoned decimal bytes")
+	fmt.Println("    Example: INREC=(10,5,ZD=8,1X,0,10,LENGTH=40)")
+	fmt.Println("  SUM=(s,l,...) Collapse records with equal keys, totalling these numeric fields")
+	fmt.Println("  SUMOVFL=<KEEP|FAIL> On a total that does not fit: write the records unsummed or fail")
+	fmt.Println("  SEQ=(p,l)     Insert an l-digit sequence number at position p (END appends)")
+	fmt.Println("  SEQKEY=(s,l)  Restart the sequence number when this field changes")
+	fmt.Println("  JOIN=<type>   Join I= (F1) with F2= on J1/J2 keys: INNER, LEFT, RIGHT or FULL")
+	fmt.Println("  F2=<file>     Second file of a join")
+	fmt.Println("  J1=(...)      Join key of F1, options as in S1 (repeat for more keys)")
+	fmt.Println("  J2=(...)      Join key of F2, matched in order with the J1 keys")
+	fmt.Println("  SORTED=<Y|N>  The join files are already sorted on their join keys")
+	fmt.Println("  UNPAIRED1=<file> Write F1 records without a match to a file (UNPAIRED2 for F2)")
+	fmt.Println("  REFORMAT=(...) Build the joined record, e.g. (F1:0,10,F2:5,8); items as in INREC")
+	fmt.Println("                 Required unless RT=F; without it fixed records are joined side by side")
+	fmt.Println("  SET=<op>      Combine inputs sorted on S1..: UNION, INTERSECT or EXCEPT (first minus the rest)")
+	fmt.Println("  SETCOUNT=<Y|N> Prefix each SET= record with the number of records sharing its key")
 	fmt.Println("  S1=(...)      Sort key definition")
 	fmt.Println("    Sort key options (S1, S2, ...):")
 	fmt.Println("      e=<start>       Start position (0-based)")
@@ -59,8 +128,27 @@ func HasAnyPrefix(s string, prefixes []string) bool {
 	return false
 }
 
+// splitList splits a value like "(a,b,c)" into its items. A value without
+// parentheses is a single item.
+func splitList(val string) []string {
+	if !strings.HasPrefix(val, "(") || !strings.HasSuffix(val, ")") {
+		return []string{val}
+	}
+	var items []string
+	for _, item := range strings.Split(val[1:len(val)-1], ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func ParseXSSortParams(params string) Config {
 	cfg := Config{}
+	// SUM= is compiled once SUMOVFL= is known
+	var sumFields string
+	var sumFail bool
+	var seqKey *sorting.SortKey
 
 	// Split the single string into parts on comma followed by optional space
 	var parts []string
@@ -93,6 +181,7 @@ func ParseXSSortParams(params string) Config {
 
 	// Iterate over each parameter individually (no splitting on spaces or commas)
 	sortKeyRegex := regexp.MustCompile(`(?i)^\s*s\d+=\((.*?)\)`)
+	joinKeyRegex := regexp.MustCompile(`(?i)^\s*j([12])=\((.*?)\)`)
 
 	for _, part := range parts {
 		// remove leading/trailing whitespace and carriage returns
@@ -104,6 +193,7 @@ func ParseXSSortParams(params string) Config {
 		switch {
 		case strings.HasPrefix(strings.ToUpper(part), "I="):
 			cfg.InputFile = strings.TrimSpace(strings.TrimPrefix(part, "I="))
+			cfg.InputFiles = splitList(cfg.InputFile)
 		case strings.HasPrefix(strings.ToUpper(part), "O="):
 			cfg.OutputFile = strings.TrimSpace(strings.TrimPrefix(part, "O="))
 		case strings.HasPrefix(strings.ToUpper(part), "RL="):
@@ -114,73 +204,139 @@ func ParseXSSortParams(params string) Config {
 			val := strings.TrimSpace(strings.TrimPrefix(part, "TS="))
 			cfg.TruncateSpaces = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
 		case strings.HasPrefix(strings.ToUpper(part), "RD="):
-			val := strings.TrimSpace(strings.TrimPrefix(part, "RD="))
-			cfg.RemoveDuplicates = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
+			val := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(part, "RD=")))
+			cfg.DedupByKey = val == "KEY"
+			cfg.RemoveDuplicates = (val == "Y" || val == "YES" || val == "REC" || cfg.DedupByKey)
+		case strings.HasPrefix(strings.ToUpper(part), "XSUM="):
+			cfg.XsumFile = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "XSUMLN="):
+			val := strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+			cfg.XsumLineNumbers = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "KEEP="):
+			val := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(part, "KEEP=")))
+			cfg.KeepLast = (val == "L" || val == "LAST")
 		case strings.HasPrefix(strings.ToUpper(part), "EN="):
 			cfg.EmptyNumbers = strings.TrimSpace(strings.TrimPrefix(part, "EN="))
 		case strings.HasPrefix(strings.ToUpper(part), "TMP=") ||
 			strings.HasPrefix(strings.ToUpper(part), "TEMPDIR="):
 			cfg.TempDir = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
 		case strings.HasPrefix(strings.ToUpper(part), "MEM="):
-			cfg.Memory = strings.TrimSpace(strings.TrimPrefix(part, "MEM="))
+			mem, err := utils.ParseSize(strings.SplitN(part, "=", 2)[1])
+			if err != nil {
+				fmt.Printf("Error: Invalid MEM: %v\n", err)
+				PrintXMSortUsage()
+				ExitFunc(1)
+			}
+			cfg.Memory = mem
+		case strings.HasPrefix(strings.ToUpper(part), "EQUALS=") ||
+			strings.HasPrefix(strings.ToUpper(part), "TAG="):
+			val := strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+			cfg.Stable = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "MERGE="):
+			val := strings.TrimSpace(strings.TrimPrefix(part, "MERGE="))
+			cfg.MergeOnly = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "VERIFY="):
+			val := strings.TrimSpace(strings.TrimPrefix(part, "VERIFY="))
+			cfg.VerifyOrder = (strings.ToUpper(val) == "Y" || strings.ToUpper(val) == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "CHECK="):
+			val := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(part, "CHECK=")))
+			cfg.CountViolations = val == "ALL"
+			cfg.CheckOrder = (val == "Y" || val == "YES" || cfg.CountViolations)
+
+		case strings.HasPrefix(strings.ToUpper(part), "SKIPREC="):
+			fmt.Sscanf(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]), "%d", &cfg.SkipRecords)
+		case strings.HasPrefix(strings.ToUpper(part), "STOPAFT="):
+			fmt.Sscanf(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]), "%d", &cfg.StopAfter)
+		case strings.HasPrefix(strings.ToUpper(part), "LIMIT="):
+			fmt.Sscanf(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]), "%d", &cfg.Limit)
+
+		case strings.HasPrefix(strings.ToUpper(part), "INCLUDE="):
+			cfg.Include = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "OMIT="):
+			cfg.Omit = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "SUM="):
+			sumFields = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "SUMOVFL="):
+			val := strings.ToUpper(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+			sumFail = val == "FAIL"
+		case strings.HasPrefix(strings.ToUpper(part), "SEQ="):
+			seq, err := sorting.ParseSeqNum(strings.SplitN(part, "=", 2)[1])
+			if err != nil {
+				fmt.Printf("Error: Invalid SEQ: %v\n", err)
+				PrintXMSortUsage()
+				ExitFunc(1)
+			}
+			cfg.SeqNum = seq
+		case strings.HasPrefix(strings.ToUpper(part), "SEQKEY="):
+			key, err := sorting.ParseSeqKey(strings.SplitN(part, "=", 2)[1])
+			if err != nil {
+				fmt.Printf("Error: Invalid SEQKEY: %v\n", err)
+				PrintXMSortUsage()
+				ExitFunc(1)
+			}
+			seqKey = key
+		case strings.HasPrefix(strings.ToUpper(part), "JOIN="):
+			val := strings.ToUpper(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+			joinType, err := merging.ParseJoinType(val)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				PrintXMSortUsage()
+				ExitFunc(1)
+			}
+			cfg.Join = true
+			cfg.JoinType = joinType
+		case strings.HasPrefix(strings.ToUpper(part), "SET="):
+			val := strings.ToUpper(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+			op, err := merging.ParseSetOp(val)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				PrintXMSortUsage()
+				ExitFunc(1)
+			}
+			cfg.SetOperation = true
+			cfg.SetOp = op
+		case strings.HasPrefix(strings.ToUpper(part), "SETCOUNT="):
+			val := strings.ToUpper(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+			cfg.SetCounts = (val == "Y" || val == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "F2="):
+			cfg.JoinFiles = splitList(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+		case strings.HasPrefix(strings.ToUpper(part), "SORTED="):
+			val := strings.ToUpper(strings.TrimSpace(strings.SplitN(part, "=", 2)[1]))
+			cfg.JoinSorted = (val == "Y" || val == "YES")
+		case strings.HasPrefix(strings.ToUpper(part), "UNPAIRED1="):
+			cfg.Unpaired1 = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "UNPAIRED2="):
+			cfg.Unpaired2 = strings.TrimSpace(strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "REFORMAT="):
+			cfg.JoinReformat = parseReformat("REFORMAT", strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "INREC="):
+			cfg.Inrec = parseReformat("INREC", strings.SplitN(part, "=", 2)[1])
+		case strings.HasPrefix(strings.ToUpper(part), "OUTREC="):
+			cfg.Outrec = parseReformat("OUTREC", strings.SplitN(part, "=", 2)[1])
 
 		// Sorteersleutels
+		case joinKeyRegex.MatchString(part):
+			m := joinKeyRegex.FindStringSubmatch(part)
+			if m[1] == "1" {
+				cfg.JoinKeys1 = append(cfg.JoinKeys1, parseSortKey(m[2]))
+			} else {
+				cfg.JoinKeys2 = append(cfg.JoinKeys2, parseSortKey(m[2]))
+			}
 		case sortKeyRegex.MatchString(part):
 			m := sortKeyRegex.FindStringSubmatch(part)
 			if len(m) > 1 {
-				args := strings.Split(m[1], ",")
-				var start, length int
-				numeric := false
-				asc := true
-				collation := ""
-
-				for _, arg := range args {
-					kv := strings.SplitN(arg, "=", 2)
-					if len(kv) != 2 {
-						continue
-					}
-					key, val := strings.ToLower(strings.TrimSpace(kv[0])), strings.ToLower(strings.TrimSpace(kv[1]))
-					switch key {
-					case "e":
-						fmt.Sscanf(val, "%d", &start)
-					case "l":
-						fmt.Sscanf(val, "%d", &length)
-					case "p":
-						var s, e int
-						if _, err := fmt.Sscanf(val, "%d-%d", &s, &e); err == nil {
-							start = s
-							length = e - s + 1
-						}
-					case "g":
-						collation = val
-						if val == "numeric" {
-							numeric = true
-						}
-					case "v":
-						if val == "d" {
-							asc = false
-						}
-					}
-				}
-
-				cfg.SortKeys = append(cfg.SortKeys, sorting.SortKey{
-					Start:     start,
-					Length:    length,
-					Numeric:   numeric,
-					Asc:       asc,
-					Collation: collation,
-				})
+				cfg.SortKeys = append(cfg.SortKeys, parseSortKey(m[1]))
 			}
 		}
 	}
 
 	// Validate required parameters
-	if cfg.InputFile == "" {
+	if len(cfg.InputFiles) == 0 || cfg.InputFiles[0] == "" {
 		fmt.Println("Error: Input file (I=...) is required.")
 		PrintXMSortUsage()
 		ExitFunc(1)
 	}
-	if cfg.OutputFile == "" {
+	if cfg.OutputFile == "" && !cfg.CheckOrder {
 		fmt.Println("Error: Output file (O=...) is required.")
 		PrintXMSortUsage()
 		ExitFunc(1)
@@ -190,10 +346,148 @@ func ParseXSSortParams(params string) Config {
 		PrintXMSortUsage()
 		ExitFunc(1)
 	}
-	if len(cfg.SortKeys) == 0 {
+	if len(cfg.SortKeys) == 0 && !cfg.Join {
 		fmt.Println("Error: At least one sort key (S1=...) must be specified.")
 		PrintXMSortUsage()
 		ExitFunc(1)
 	}
+	if cfg.Join {
+		validateJoin(&cfg)
+	}
+	if cfg.SkipRecords < 0 || cfg.StopAfter < 0 || cfg.Limit < 0 {
+		fmt.Println("Error: SKIPREC=, STOPAFT= and LIMIT= cannot be negative.")
+		PrintXMSortUsage()
+		ExitFunc(1)
+	}
+	if cfg.Include != "" && cfg.Omit != "" {
+		fmt.Println("Error: INCLUDE= and OMIT= cannot be combined.")
+		PrintXMSortUsage()
+		ExitFunc(1)
+	}
+	if cfg.Include != "" || cfg.Omit != "" {
+		filter, err := sorting.ParseFilter(cfg.Include+cfg.Omit, cfg.Omit != "")
+		if err != nil {
+			fmt.Printf("Error: Invalid INCLUDE/OMIT condition: %v\n", err)
+			PrintXMSortUsage()
+			ExitFunc(1)
+		}
+		cfg.Filter = filter
+	}
+	if seqKey != nil {
+		if cfg.SeqNum == nil {
+			fmt.Println("Error: SEQKEY= needs SEQ=.")
+			PrintXMSortUsage()
+			ExitFunc(1)
+		} else {
+			cfg.SeqNum.RestartKey = seqKey
+		}
+	}
+	if sumFields != "" {
+		sum, err := sorting.ParseSumFields(sumFields)
+		if err != nil {
+			fmt.Printf("Error: Invalid SUM fields: %v\n", err)
+			PrintXMSortUsage()
+			ExitFunc(1)
+		} else {
+			sum.FailOnOverflow = sumFail
+			cfg.Sum = sum
+		}
+	}
 	return cfg
 }
+
+// parseReformat compiles an INREC= or OUTREC= value and exits when it is
+// invalid.
+func parseReformat(name, val string) *sorting.Reformat {
+	r, err := sorting.ParseReformat(strings.TrimSpace(val))
+	if err != nil {
+		fmt.Printf("Error: Invalid %s: %v\n", name, err)
+		PrintXMSortUsage()
+		ExitFunc(1)
+	}
+	return r
+}
+
+// parseSortKey parses the options of a sort or join key, e.g.
+// e=0,l=5,g=ascii,v=a.
+func parseSortKey(spec string) sorting.SortKey {
+	args := strings.Split(spec, ",")
+	var start, length int
+	numeric := false
+	asc := true
+	collation := ""
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.ToLower(strings.TrimSpace(kv[0])), strings.ToLower(strings.TrimSpace(kv[1]))
+		switch key {
+		case "e":
+			fmt.Sscanf(val, "%d", &start)
+		case "l":
+			fmt.Sscanf(val, "%d", &length)
+		case "p":
+			var s, e int
+			if _, err := fmt.Sscanf(val, "%d-%d", &s, &e); err == nil {
+				start = s
+				length = e - s + 1
+			}
+		case "g":
+			collation = val
+			if val == "numeric" {
+				numeric = true
+			}
+		case "v":
+			if val == "d" {
+				asc = false
+			}
+		}
+	}
+
+	return sorting.SortKey{
+		Start:     start,
+		Length:    length,
+		Numeric:   numeric,
+		Asc:       asc,
+		Collation: collation,
+	}
+}
+
+// validateJoin checks that the join files and keys fit together.
+func validateJoin(cfg *Config) {
+	if len(cfg.JoinFiles) == 0 || cfg.JoinFiles[0] == "" {
+		fmt.Println("Error: JOIN= needs a second file (F2=...).")
+		PrintXMSortUsage()
+		ExitFunc(1)
+		return
+	}
+	if len(cfg.JoinKeys1) == 0 || len(cfg.JoinKeys1) != len(cfg.JoinKeys2) {
+		fmt.Println("Error: JOIN= needs the same number of J1= and J2= keys.")
+		PrintXMSortUsage()
+		ExitFunc(1)
+		return
+	}
+	for i, key := range cfg.JoinKeys1 {
+		other := cfg.JoinKeys2[i]
+		if key.Numeric != other.Numeric || key.Asc != other.Asc {
+			fmt.Printf("Error: Join key %d has a different type or order in J1= and J2=.\n", i+1)
+			PrintXMSortUsage()
+			ExitFunc(1)
+			return
+		}
+		if key.EBCDIC() != other.EBCDIC() {
+			fmt.Printf("Error: Join key %d has a different collation in J1= and J2=.\n", i+1)
+			PrintXMSortUsage()
+			ExitFunc(1)
+			return
+		}
+	}
+	if cfg.JoinReformat == nil && cfg.Delimiter == "" && strings.ToUpper(cfg.RecordType) != "F" {
+		fmt.Println("Error: JOIN= of variable-length records needs REFORMAT=, or RT=F.")
+		PrintXMSortUsage()
+		ExitFunc(1)
+		return
+	}
+}
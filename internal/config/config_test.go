@@ -1,13 +1,13 @@
 package config_test
 
 import (
+	"os"
 	"testing"
 
 	"github.com/joeymeijers/xmsort/internal/config"
+	"github.com/joeymeijers/xmsort/internal/merging"
 )
 
-
-
 func TestParseXSSortParams(t *testing.T) {
 	params := `I=input.txt, O=output.txt, RL=122, RT=V, TS=Y, RD=N, EN=Z, TMP=/tmp, MEM=256M, S1=(e=1,l=9,g=numeric,v=a), S2=(e=23,l=30,g=ebcdic,v=d)`
 	cfg := config.ParseXSSortParams(params)
@@ -36,6 +36,9 @@ func TestParseXSSortParams(t *testing.T) {
 	if cfg.SortKeys[1].Asc {
 		t.Errorf("sortkey2 should be descending")
 	}
+	if cfg.Memory != 256<<20 {
+		t.Errorf("expected MEM=256M -> %d, got %d", 256<<20, cfg.Memory)
+	}
 }
 
 func TestParseXSSortParams_PStyle(t *testing.T) {
@@ -94,4 +97,235 @@ func TestParseXSSortParams_InvalidSortKeyIgnored(t *testing.T) {
 	if len(cfg.SortKeys) != 1 {
 		t.Fatalf("expected 1 valid sort key, got %d", len(cfg.SortKeys))
 	}
-}
\ No newline at end of file
+}
+func TestParseXSSortParams_MultipleInputs(t *testing.T) {
+	params := `I=(day1.dat, day2.dat,/data/*.dat), O=out.txt, RL=50, TAG=Y, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	expected := []string{"day1.dat", "day2.dat", "/data/*.dat"}
+	if len(cfg.InputFiles) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, cfg.InputFiles)
+	}
+	for i := range expected {
+		if cfg.InputFiles[i] != expected[i] {
+			t.Errorf("input %d: expected %s, got %s", i, expected[i], cfg.InputFiles[i])
+		}
+	}
+	if !cfg.Stable {
+		t.Errorf("expected TAG=Y -> stable")
+	}
+}
+
+func TestParseXSSortParams_MergeOnly(t *testing.T) {
+	params := `I=(north.dat,south.dat), O=out.txt, RL=50, MERGE=Y, VERIFY=Y, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if !cfg.MergeOnly {
+		t.Errorf("expected MERGE=Y -> true")
+	}
+	if !cfg.VerifyOrder {
+		t.Errorf("expected VERIFY=Y -> true")
+	}
+}
+
+func TestParseXSSortParams_CheckWithoutOutput(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	cfg := config.ParseXSSortParams(`I=in.txt, RL=50, CHECK=ALL, S1=(e=0,l=5,g=ascii,v=a)`)
+
+	if exited {
+		t.Errorf("O= should not be required with CHECK")
+	}
+	if !cfg.CheckOrder || !cfg.CountViolations {
+		t.Errorf("expected CHECK=ALL -> check and count, got %+v", cfg)
+	}
+}
+
+func TestParseXSSortParams_DedupByKeyKeepLast(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, RD=KEY, KEEP=LAST, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if !cfg.RemoveDuplicates || !cfg.DedupByKey {
+		t.Errorf("expected RD=KEY -> remove duplicates by key, got %+v", cfg)
+	}
+	if !cfg.KeepLast {
+		t.Errorf("expected KEEP=LAST -> true")
+	}
+}
+
+func TestParseXSSortParams_Xsum(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, RD=KEY, XSUM=removed.txt, XSUMLN=Y, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.XsumFile != "removed.txt" {
+		t.Errorf("expected XSUM=removed.txt, got %s", cfg.XsumFile)
+	}
+	if !cfg.XsumLineNumbers {
+		t.Errorf("expected XSUMLN=Y -> true")
+	}
+}
+
+func TestParseXSSortParams_Equals(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, EQUALS=Y, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if !cfg.Stable {
+		t.Errorf("expected EQUALS=Y -> stable")
+	}
+}
+
+func TestParseXSSortParams_Include(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, INCLUDE=(0,2,EQ,'01',OR,0,2,EQ,'02'), S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.Include != "(0,2,EQ,'01',OR,0,2,EQ,'02')" {
+		t.Errorf("include parsed wrong: %s", cfg.Include)
+	}
+	if cfg.Filter == nil || !cfg.Filter.Keep("02xyz", "", false) || cfg.Filter.Keep("03xyz", "", false) {
+		t.Errorf("include filter compiled wrong")
+	}
+}
+
+func TestParseXSSortParams_InvalidFilterExits(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	config.ParseXSSortParams(`I=in.txt, O=out.txt, RL=50, OMIT=(0,2,XX,'01'), S1=(e=0,l=5,g=ascii,v=a)`)
+
+	if !exited {
+		t.Errorf("expected exit on invalid OMIT condition")
+	}
+}
+
+func TestParseXSSortParams_InvalidMemoryExits(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	config.ParseXSSortParams(`I=in.txt, O=out.txt, MEM=lots, S1=(e=0,l=5,g=ascii,v=a)`)
+
+	if !exited {
+		t.Errorf("expected exit on invalid MEM")
+	}
+}
+
+func TestParseXSSortParams_Reformat(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, INREC=(5,3,0,5), OUTREC=(0,3,'|',LENGTH=6), S1=(e=0,l=3,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.Inrec == nil || cfg.Inrec.Apply("abcdeXYZ", "") != "XYZabcde" {
+		t.Errorf("inrec compiled wrong")
+	}
+	if cfg.Outrec == nil || cfg.Outrec.Apply("XYZabcde", "") != "XYZ|  " {
+		t.Errorf("outrec compiled wrong")
+	}
+}
+
+func TestParseXSSortParams_Sum(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, SUM=(10,8,20,5), SUMOVFL=FAIL, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.Sum == nil || len(cfg.Sum.Fields) != 2 || cfg.Sum.Fields[1].Start != 20 || !cfg.Sum.FailOnOverflow {
+		t.Errorf("sum parsed wrong: %+v", cfg.Sum)
+	}
+}
+
+func TestParseXSSortParams_SeqNum(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, SEQKEY=(0,2), SEQ=(END,6), S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.SeqNum == nil || !cfg.SeqNum.Append || cfg.SeqNum.Width != 6 {
+		t.Fatalf("seq parsed wrong: %+v", cfg.SeqNum)
+	}
+	if cfg.SeqNum.RestartKey == nil || cfg.SeqNum.RestartKey.Length != 2 {
+		t.Errorf("seq key parsed wrong: %+v", cfg.SeqNum.RestartKey)
+	}
+}
+
+func TestParseXSSortParams_SkipStop(t *testing.T) {
+	params := `I=in.txt, O=out.txt, RL=50, SKIPREC=10, STOPAFT=500, S1=(e=0,l=5,g=ascii,v=a)`
+	cfg := config.ParseXSSortParams(params)
+
+	if cfg.SkipRecords != 10 || cfg.StopAfter != 500 {
+		t.Errorf("limits parsed wrong: skip %d, stop %d", cfg.SkipRecords, cfg.StopAfter)
+	}
+}
+
+func TestParseXSSortParams_Limit(t *testing.T) {
+	cfg := config.ParseXSSortParams(`I=in.txt, O=out.txt, RL=50, LIMIT=1000, S1=(e=0,l=5,g=ascii,v=d)`)
+
+	if cfg.Limit != 1000 {
+		t.Errorf("limit parsed wrong: %d", cfg.Limit)
+	}
+}
+
+func TestParseXSSortParams_Join(t *testing.T) {
+	params := `I=cust.txt, F2=(tx1.txt,tx2.txt), O=out.txt, RL=50, JOIN=left, J1=(e=0,l=6), J2=(e=10,l=6), ` +
+		`SORTED=Y, UNPAIRED2=orphans.txt, REFORMAT=(F1:0,6,F2:0,10)`
+	cfg := config.ParseXSSortParams(params)
+
+	if !cfg.Join || cfg.JoinType != merging.LeftJoin {
+		t.Errorf("join type parsed wrong: %v", cfg.JoinType)
+	}
+	if len(cfg.JoinFiles) != 2 || cfg.JoinFiles[1] != "tx2.txt" {
+		t.Errorf("join files parsed wrong: %v", cfg.JoinFiles)
+	}
+	if len(cfg.JoinKeys1) != 1 || len(cfg.JoinKeys2) != 1 || cfg.JoinKeys2[0].Start != 10 {
+		t.Errorf("join keys parsed wrong: %v / %v", cfg.JoinKeys1, cfg.JoinKeys2)
+	}
+	if !cfg.JoinSorted || cfg.Unpaired2 != "orphans.txt" || cfg.JoinReformat == nil {
+		t.Errorf("join options parsed wrong: %+v", cfg)
+	}
+}
+
+func TestParseXSSortParams_JoinKeysMustMatch(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	config.ParseXSSortParams(`I=a.txt, F2=b.txt, O=out.txt, RL=50, JOIN=INNER, J1=(e=0,l=6,g=numeric), J2=(e=0,l=6)`)
+
+	if !exited {
+		t.Errorf("expected exit on join keys of different types")
+	}
+}
+
+func TestParseXSSortParams_JoinKeysMustShareCollation(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	config.ParseXSSortParams(`I=a.txt, F2=b.txt, O=out.txt, RL=50, JOIN=INNER, J1=(e=0,l=6,g=ebcdic), J2=(e=0,l=6,g=ascii)`)
+
+	if !exited {
+		t.Errorf("expected exit on join keys of different collations")
+	}
+}
+
+func TestParseXSSortParams_VariableJoinNeedsReformat(t *testing.T) {
+	exited := false
+	config.ExitFunc = func(int) { exited = true }
+	defer func() { config.ExitFunc = os.Exit }()
+
+	config.ParseXSSortParams(`I=a.txt, F2=b.txt, O=out.txt, RL=50, JOIN=INNER, J1=(e=0,l=6), J2=(e=0,l=6)`)
+	if !exited {
+		t.Errorf("expected exit on a variable-length join without REFORMAT=")
+	}
+
+	exited = false
+	config.ParseXSSortParams(`I=a.txt, F2=b.txt, O=out.txt, RL=50, RT=F, JOIN=INNER, J1=(e=0,l=6), J2=(e=0,l=6)`)
+	if exited {
+		t.Errorf("fixed-length records join without REFORMAT=")
+	}
+}
+
+func TestParseXSSortParams_SetOperation(t *testing.T) {
+	cfg := config.ParseXSSortParams(`I=(a.txt,b.txt), O=out.txt, RL=50, SET=except, SETCOUNT=Y, S1=(e=0,l=5)`)
+
+	if !cfg.SetOperation || cfg.SetOp != merging.Except || !cfg.SetCounts {
+		t.Errorf("set operation parsed wrong: %v %v %v", cfg.SetOperation, cfg.SetOp, cfg.SetCounts)
+	}
+}
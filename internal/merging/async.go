@@ -0,0 +1,174 @@
+package merging
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+)
+
+const (
+	// prefetchRecords and prefetchBytes bound one read-ahead batch; merges
+	// short of memory use smaller batches.
+	prefetchRecords = 1024
+	prefetchBytes   = 1 << 20
+	// prefetchDepth is the number of batches read ahead per run.
+	prefetchDepth = 2
+	// writeBehindSize is the largest size of each of the two output buffers.
+	writeBehindSize = 2 << 20
+)
+
+// prefetchReader reads the records of an input ahead in a background
+// goroutine, so the merge does not wait for the disk while other inputs have
+// records.
+type prefetchReader struct {
+	batchBytes int
+	batches    chan prefetchBatch
+	stop       chan struct{}
+	batch      prefetchBatch
+	pos        int
+}
+
+type prefetchBatch struct {
+	records []sorting.Record
+	err     error // io.EOF or the read error after records
+}
+
+// recordSize is the memory of a batched record besides its bytes.
+const recordSize = int(unsafe.Sizeof(sorting.Record{}))
+
+// newPrefetchReader reads ahead in batches of up to batchBytes.
+func newPrefetchReader(r recordSource, batchBytes int) *prefetchReader {
+	p := &prefetchReader{
+		batchBytes: batchBytes,
+		batches:    make(chan prefetchBatch, prefetchDepth),
+		stop:       make(chan struct{}),
+	}
+	go p.fill(r)
+	return p
+}
+
+func (p *prefetchReader) fill(r recordSource) {
+	for {
+		batch := prefetchBatch{records: make([]sorting.Record, 0, prefetchRecords)}
+		for size := 0; len(batch.records) < prefetchRecords && size < p.batchBytes; {
+			line, seq, err := r.Read()
+			if err != nil {
+				batch.err = err
+				break
+			}
+			batch.records = append(batch.records, sorting.Record{Line: line, Seq: seq})
+			size += len(line) + recordSize
+		}
+		select {
+		case p.batches <- batch:
+		case <-p.stop:
+			return
+		}
+		if batch.err != nil {
+			return
+		}
+	}
+}
+
+// Read returns the next record like recordSource.Read.
+func (p *prefetchReader) Read() (string, int64, error) {
+	for p.pos >= len(p.batch.records) {
+		if p.batch.err != nil {
+			return "", 0, p.batch.err
+		}
+		p.batch, p.pos = <-p.batches, 0
+	}
+	record := p.batch.records[p.pos]
+	p.pos++
+	return record.Line, record.Seq, nil
+}
+
+// Close stops reading ahead; close the input's file after it.
+func (p *prefetchReader) Close() {
+	close(p.stop)
+}
+
+// asyncWriter writes behind: it fills one buffer while a background
+// goroutine writes the other, so the merge does not wait for the disk. A
+// write error is returned by the calls after it.
+type asyncWriter struct {
+	w    io.Writer
+	buf  []byte
+	free chan []byte // buffers that have been written
+	full chan []byte // buffers waiting to be written
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newAsyncWriter(w io.Writer, size int) *asyncWriter {
+	a := &asyncWriter{
+		w:    w,
+		buf:  make([]byte, 0, size),
+		free: make(chan []byte, 1),
+		full: make(chan []byte, 1),
+		done: make(chan struct{}),
+	}
+	a.free <- make([]byte, 0, size)
+	go a.drain()
+	return a
+}
+
+func (a *asyncWriter) drain() {
+	defer close(a.done)
+	for b := range a.full {
+		if a.failed() == nil {
+			if _, err := a.w.Write(b); err != nil {
+				a.mu.Lock()
+				a.err = err
+				a.mu.Unlock()
+			}
+		}
+		a.free <- b[:0]
+	}
+}
+
+func (a *asyncWriter) failed() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	if err := a.failed(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(a.buf[len(a.buf):cap(a.buf)], p)
+		a.buf, p = a.buf[:len(a.buf)+c], p[c:]
+		if len(a.buf) == cap(a.buf) {
+			a.full <- a.buf
+			a.buf = <-a.free
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the buffered bytes and waits until everything is written.
+func (a *asyncWriter) Flush() error {
+	if len(a.buf) > 0 {
+		a.full <- a.buf
+		a.buf = <-a.free
+	}
+	// The other buffer comes back once it is written
+	a.free <- <-a.free
+	return a.failed()
+}
+
+// Close flushes the writer and stops its goroutine. It does not close the
+// underlying writer.
+func (a *asyncWriter) Close() error {
+	err := a.Flush()
+	close(a.full)
+	<-a.done
+	return err
+}
@@ -0,0 +1,84 @@
+package merging
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchReader_ReadsAllRecords(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	const n = 3*prefetchRecords + 5
+	for i := range n {
+		require.NoError(t, rw.Write(fmt.Sprintf("line %d", i), int64(i+1)))
+	}
+	require.NoError(t, w.Flush())
+
+	p := newPrefetchReader(utils.NewRunReader(bufio.NewReader(&buf)), prefetchBytes)
+	defer p.Close()
+	for i := range n {
+		line, seq, err := p.Read()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("line %d", i), line)
+		require.Equal(t, int64(i+1), seq)
+	}
+	_, _, err = p.Read()
+	assert.Equal(t, io.EOF, err)
+	_, _, err = p.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPrefetchReader_CloseBeforeEnd(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	for i := range 10 * prefetchRecords {
+		require.NoError(t, rw.Write("x", int64(i+1)))
+	}
+	require.NoError(t, w.Flush())
+
+	p := newPrefetchReader(utils.NewRunReader(bufio.NewReader(&buf)), prefetchBytes)
+	_, _, err = p.Read()
+	require.NoError(t, err)
+	p.Close() // the reader goroutine stops while blocked on a full queue
+}
+
+func TestAsyncWriter_WritesInOrder(t *testing.T) {
+	var out bytes.Buffer
+	a := newAsyncWriter(&out, 7)
+	var want bytes.Buffer
+	for i := range 100 {
+		s := fmt.Sprintf("record %d\n", i)
+		want.WriteString(s)
+		_, err := a.Write([]byte(s))
+		require.NoError(t, err)
+		if i == 50 {
+			require.NoError(t, a.Flush())
+			assert.Equal(t, want.String(), out.String())
+		}
+	}
+	require.NoError(t, a.Close())
+	assert.Equal(t, want.String(), out.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAsyncWriter_ReportsWriteError(t *testing.T) {
+	a := newAsyncWriter(failingWriter{}, 4)
+	_, err := a.Write([]byte("some bytes"))
+	require.NoError(t, err, "the first buffers are written in the background")
+	assert.EqualError(t, a.Close(), "disk full")
+}
@@ -0,0 +1,55 @@
+package merging
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// recordSource reads the records of a merge input with their record
+// numbers, or io.EOF at the end.
+type recordSource interface {
+	Read() (string, int64, error)
+}
+
+// textInput reads an input in the job's record layout and numbers its
+// records from 1.
+type textInput struct {
+	records *sorting.RecordReader
+	seq     int64
+}
+
+func (t *textInput) Read() (string, int64, error) {
+	line, _, err := t.records.Next()
+	if err != nil {
+		return "", 0, err
+	}
+	t.seq++
+	return line, t.seq, nil
+}
+
+// openInput opens a file to merge. A run is recognized by its header; any
+// other input holds records as laid out by opts (RT= and RL=). STDIO reads
+// standard input.
+func openInput(name string, opts sorting.Options) (recordSource, io.Closer, error) {
+	f, err := utils.OpenInput(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(f)
+	if run := utils.NewRunReader(r); run.Framed() {
+		return run, f, nil
+	}
+	return &textInput{records: sorting.NewRecordReaderFrom(r, opts.RecordType, opts.RecordLength)}, f, nil
+}
+
+// closeInputs closes the inputs that are open.
+func closeInputs(files []io.Closer) {
+	for _, f := range files {
+		if f != nil {
+			utils.SafeClose(f)
+		}
+	}
+}
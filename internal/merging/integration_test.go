@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,7 +21,7 @@ func TestMergeChunksIntegration(t *testing.T) {
 	keys := []sorting.SortKey{
 		{Start: 0, Length: 6, Numeric: false, Asc: false},
 	}
-	err := MergeChunks(outputFile, []string{chunk1, chunk2}, keys, ",")
+	err := MergeChunks(outputFile, []string{chunk1, chunk2}, sorting.Options{SortKeys: keys, Delimiter: ","})
 	assert.NoError(t, err)
 
 	data, err := os.ReadFile(outputFile)
@@ -30,3 +31,269 @@ func TestMergeChunksIntegration(t *testing.T) {
 	assert.Contains(t, lines, "banana")
 	assert.Contains(t, lines, "orange")
 }
+
+func TestMergeChunksKeepsRunOrderForEqualKeys(t *testing.T) {
+	chunk1 := createTempFile(t, "a first\nb first\n")
+	chunk2 := createTempFile(t, "a second\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Stable:   true,
+	}
+	err := MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a first\na second\nb first\n", string(data))
+}
+
+func TestMergeSortedInputsKeepsInputs(t *testing.T) {
+	input1 := createTempFile(t, "a\nc\n")
+	input2 := createTempFile(t, "b\nd\n")
+	defer os.Remove(input1)
+	defer os.Remove(input2)
+
+	outputFile := input1 + "_out.txt"
+	defer os.Remove(outputFile)
+
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	err := Merge(outputFile, []string{input1, input2}, opts, MergeMode{KeepInputs: true, VerifyOrder: true})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\nd\n", string(data))
+	assert.FileExists(t, input1)
+	assert.FileExists(t, input2)
+}
+
+func TestMergeSortedInputsVerifyOrder(t *testing.T) {
+	input1 := createTempFile(t, "a\nc\nb\n")
+	input2 := createTempFile(t, "b\nd\n")
+	defer os.Remove(input1)
+	defer os.Remove(input2)
+
+	outputFile := input1 + "_out.txt"
+	defer os.Remove(outputFile)
+
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	err := Merge(outputFile, []string{input1, input2}, opts, MergeMode{KeepInputs: true, VerifyOrder: true})
+	assert.ErrorContains(t, err, "line 3 sorts before line 2")
+	assert.NoFileExists(t, outputFile)
+}
+
+func TestMergeSortedInputsFixedRecords(t *testing.T) {
+	input1 := createTempFile(t, "aacc")
+	input2 := createTempFile(t, "bbdd")
+	defer os.Remove(input1)
+	defer os.Remove(input2)
+
+	outputFile := input1 + "_out.txt"
+	defer os.Remove(outputFile)
+
+	opts := sorting.Options{
+		SortKeys:     []sorting.SortKey{{Start: 0, Length: 2, Asc: true}},
+		RecordType:   "F",
+		RecordLength: 2,
+	}
+	err := Merge(outputFile, []string{input1, input2}, opts, MergeMode{KeepInputs: true, VerifyOrder: true})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "aa\nbb\ncc\ndd\n", string(data))
+}
+
+func TestMergeSortedInputsFromStdin(t *testing.T) {
+	input1 := createTempFile(t, "a\nc\n")
+	input2 := createTempFile(t, "b\nd\n")
+	defer os.Remove(input1)
+	defer os.Remove(input2)
+
+	stdin, err := os.Open(input1)
+	assert.NoError(t, err)
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	outputFile := input1 + "_out.txt"
+	defer os.Remove(outputFile)
+
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	err = Merge(outputFile, []string{utils.STDIO, input2}, opts, MergeMode{KeepInputs: true, VerifyOrder: true})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\nd\n", string(data))
+}
+
+func TestMergeChunksRemovesDuplicatesAcrossChunks(t *testing.T) {
+	chunk1 := createTempFile(t, "a first\nb first\n")
+	chunk2 := createTempFile(t, "a second\nc second\n")
+	chunk3 := createTempFile(t, "b third\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+	defer os.Remove(chunk3)
+
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+		DedupByKey:       true,
+		KeepLast:         true,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err := MergeChunks(outputFile, []string{chunk1, chunk2, chunk3}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a second\nb third\nc second\n", string(data))
+}
+
+func TestMergeChunksRemovesIdenticalRecordsInInputOrder(t *testing.T) {
+	chunk1 := createTempFile(t, "a 3\na 1\n")
+	chunk2 := createTempFile(t, "a 2\na 1\nb 1\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Stable:           true,
+		RemoveDuplicates: true,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err := MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a 3\na 1\na 2\nb 1\n", string(data))
+}
+
+func TestMergeChunksAppliesOutrec(t *testing.T) {
+	chunk1 := createTempFile(t, "b 2\n")
+	chunk2 := createTempFile(t, "a 1\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	outrec, err := sorting.ParseReformat("(2,1,'-',0,1)")
+	assert.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Outrec:   outrec,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err = MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "1-a\n2-b\n", string(data))
+}
+
+func TestMergeChunksSumsAcrossChunks(t *testing.T) {
+	chunk1 := createTempFile(t, "a 010\nb 001\n")
+	chunk2 := createTempFile(t, "a 005\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	sum, err := sorting.ParseSumFields("(2,3)")
+	assert.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Sum:      sum,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err = MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a 015\nb 001\n", string(data))
+}
+
+func TestMergeChunksNumbersOutputInSortedOrder(t *testing.T) {
+	chunk1 := createTempFile(t, "b\nc\n")
+	chunk2 := createTempFile(t, "a\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	seq, err := sorting.ParseSeqNum("(0,3)")
+	assert.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		SeqNum:   seq,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err = MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "001a\n002b\n003c\n", string(data))
+}
+
+func TestMergeChunksStopsAtLimit(t *testing.T) {
+	chunk1 := createTempFile(t, "a 1\nc 1\n")
+	chunk2 := createTempFile(t, "a 2\nb 1\nd 1\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	sum, err := sorting.ParseSumFields("(2,1)")
+	assert.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Sum:      sum,
+		Limit:    2,
+	}
+	outputFile := chunk1 + "_out.txt"
+	defer os.Remove(outputFile)
+	err = MergeChunks(outputFile, []string{chunk1, chunk2}, opts)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a 3\nb 1\n", string(data))
+	// Inputs the merge did not finish are removed as well
+	assert.NoFileExists(t, chunk1)
+	assert.NoFileExists(t, chunk2)
+}
+
+func TestWriteSortedAppliesOutputOptions(t *testing.T) {
+	input := createTempFile(t, "b2\na1\nc3\n")
+	defer os.Remove(input)
+	outrec, err := sorting.ParseReformat("(0,1)")
+	assert.NoError(t, err)
+	seq, err := sorting.ParseSeqNum("(END,2)")
+	assert.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Outrec:   outrec,
+		SeqNum:   seq,
+		Limit:    2,
+	}
+
+	chunkFiles, sorted, err := sorting.SortFile([]string{input}, 100, t.TempDir(), opts)
+	assert.NoError(t, err)
+	assert.Empty(t, chunkFiles)
+
+	outputFile := input + "_out.txt"
+	defer os.Remove(outputFile)
+	assert.NoError(t, WriteSorted(outputFile, sorted, opts))
+	data, err := os.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "a01\nb02\n", string(data))
+}
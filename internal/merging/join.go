@@ -0,0 +1,318 @@
+package merging
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// JoinType selects which unpaired records a join writes to its output.
+type JoinType int
+
+const (
+	InnerJoin JoinType = iota // paired records only
+	LeftJoin                  // and unpaired F1 records
+	RightJoin                 // and unpaired F2 records
+	FullJoin                  // and unpaired records of both files
+)
+
+func (t JoinType) String() string {
+	return [...]string{"INNER", "LEFT", "RIGHT", "FULL"}[t]
+}
+
+// ParseJoinType parses a JOIN= value.
+func ParseJoinType(val string) (JoinType, error) {
+	switch val {
+	case "INNER":
+		return InnerJoin, nil
+	case "LEFT":
+		return LeftJoin, nil
+	case "RIGHT":
+		return RightJoin, nil
+	case "FULL":
+		return FullJoin, nil
+	}
+	return InnerJoin, fmt.Errorf("unknown join type %q (INNER, LEFT, RIGHT or FULL)", val)
+}
+
+// JoinSpec describes a join of two files sorted on their own keys (JOINKEYS).
+type JoinSpec struct {
+	Type           JoinType
+	Keys1, Keys2   []sorting.SortKey
+	Delimiter      string
+	TruncateSpaces bool
+	EmptyNumbers   string
+	// RecordType and RecordLength are the record layout of both files (RT=
+	// and RL=).
+	RecordType   string
+	RecordLength int
+	// Reformat builds the joined record; without it the F2 record follows the
+	// F1 record, separated by the delimiter. Only fixed-length layouts may
+	// join without either, as their columns tell the records apart; there the
+	// side an unpaired record lacks is filled with spaces.
+	Reformat *sorting.Reformat
+	// Unpaired1 and Unpaired2 receive the unpaired records of each file as
+	// they were read, whatever the join type.
+	Unpaired1, Unpaired2 string
+}
+
+func (s *JoinSpec) fixedLength() bool {
+	return strings.ToUpper(s.RecordType) == "F" && s.RecordLength > 0
+}
+
+// JoinStats counts the records a join wrote.
+type JoinStats struct {
+	Paired    int
+	Unpaired1 int
+	Unpaired2 int
+}
+
+// joinInput reads one file of a join and fails when it is not sorted.
+// Its records are compared on their keys encoded once (Options.Key); the
+// keys of both files encode alike, as their join keys have the same types.
+type joinInput struct {
+	name string
+	opts sorting.Options // the join keys in the file's layout
+	file io.Closer
+	run  recordSource
+	bar  *pb.ProgressBar
+	line string
+	key  string
+	seq  int64
+	ok   bool
+}
+
+func openJoinInput(name string, keys []sorting.SortKey, spec *JoinSpec, bar *pb.ProgressBar) (*joinInput, error) {
+	run, file, err := openInput(name, sorting.Options{RecordType: spec.RecordType, RecordLength: spec.RecordLength})
+	if err != nil {
+		return nil, err
+	}
+	opts := sorting.Options{
+		SortKeys:       keys,
+		Delimiter:      spec.Delimiter,
+		TruncateSpaces: spec.TruncateSpaces,
+		EmptyNumbers:   spec.EmptyNumbers,
+	}
+	in := &joinInput{name: name, opts: opts, file: file, run: run, bar: bar}
+	return in, in.next()
+}
+
+func (in *joinInput) next() error {
+	line, seq, err := in.run.Read()
+	if err == io.EOF {
+		in.ok = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	in.bar.Increment()
+	key := in.opts.Key(line)
+	if in.ok && key < in.key {
+		return fmt.Errorf("input %s is not sorted on its join keys: record %d sorts before record %d",
+			in.name, seq, in.seq)
+	}
+	in.line, in.key, in.seq, in.ok = line, key, seq, true
+	return nil
+}
+
+// group reads the records that share the key of the current record and
+// returns them with that key. A group is held in memory whole.
+func (in *joinInput) group() ([]string, string, error) {
+	if !in.ok {
+		return nil, "", nil
+	}
+	group, key := []string{in.line}, in.key
+	for {
+		if err := in.next(); err != nil {
+			return nil, "", err
+		}
+		if !in.ok || in.key != key {
+			return group, key, nil
+		}
+		group = append(group, in.line)
+	}
+}
+
+// joinWriter writes joined records and the unpaired records of each file.
+type joinWriter struct {
+	spec     *JoinSpec
+	newline  string
+	out      *bufio.Writer
+	unpaired [2]*bufio.Writer
+	stats    JoinStats
+}
+
+func (w *joinWriter) joined(f1, f2 string) error {
+	var line string
+	switch {
+	case w.spec.Reformat != nil:
+		line = w.spec.Reformat.ApplyJoined(f1, f2, w.spec.Delimiter)
+	case w.spec.Delimiter != "":
+		line = f1 + w.spec.Delimiter + f2
+	default:
+		line = f1 + f2
+	}
+	_, err := w.out.WriteString(line + w.newline)
+	return err
+}
+
+func (w *joinWriter) paired(f1, f2 string) error {
+	w.stats.Paired++
+	return w.joined(f1, f2)
+}
+
+// unpairedRecord writes a record of file 0 (F1) or 1 (F2) that has no match.
+func (w *joinWriter) unpairedRecord(file int, line string) error {
+	if u := w.unpaired[file]; u != nil {
+		if _, err := u.WriteString(line + w.newline); err != nil {
+			return err
+		}
+	}
+	if file == 0 {
+		w.stats.Unpaired1++
+		if w.spec.Type == LeftJoin || w.spec.Type == FullJoin {
+			return w.joined(line, w.missing())
+		}
+		return nil
+	}
+	w.stats.Unpaired2++
+	if w.spec.Type == RightJoin || w.spec.Type == FullJoin {
+		return w.joined(w.missing(), line)
+	}
+	return nil
+}
+
+// missing returns the record that stands in for the side an unpaired record
+// lacks: spaces of the record length in fixed-length layouts, so the fields
+// of the other side stay in their columns, and empty otherwise.
+func (w *joinWriter) missing() string {
+	if w.spec.Reformat == nil && w.spec.fixedLength() {
+		return strings.Repeat(" ", w.spec.RecordLength)
+	}
+	return ""
+}
+
+// Join merge-joins f1File and f2File, each sorted on its own join keys, into
+// outputFile. Every F1 record is paired with each F2 record of equal key, so
+// the output follows the key order of the files. The F2 records of one key
+// are held in memory while they are paired, outside Options.Memory.
+func Join(outputFile, f1File, f2File string, spec JoinSpec) (_ JoinStats, err error) {
+	if spec.Reformat == nil && spec.Delimiter == "" && !spec.fixedLength() {
+		return JoinStats{}, errors.New("a join of variable-length records needs REFORMAT= or a delimiter")
+	}
+	out, err := utils.CreateOutput(outputFile)
+	if err != nil {
+		return JoinStats{}, err
+	}
+	defer closeOutput(out, outputFile, &err)
+
+	w := &joinWriter{
+		spec:    &spec,
+		newline: utils.GetNewline(),
+		out:     bufio.NewWriterSize(out, 16*1024*1024),
+	}
+	for i, name := range []string{spec.Unpaired1, spec.Unpaired2} {
+		if name == "" {
+			continue
+		}
+		file, createErr := utils.CreateOutput(name)
+		if createErr != nil {
+			return JoinStats{}, createErr
+		}
+		defer closeOutput(file, name, &err)
+		w.unpaired[i] = bufio.NewWriter(file)
+	}
+
+	bar := utils.StartProgressBar(utils.EstimateRecordCount(f1File) + utils.EstimateRecordCount(f2File))
+	defer bar.Finish()
+
+	f1, err := openJoinInput(f1File, spec.Keys1, &spec, bar)
+	if f1 != nil {
+		defer utils.SafeClose(f1.file)
+	}
+	if err != nil {
+		return JoinStats{}, err
+	}
+	f2, err := openJoinInput(f2File, spec.Keys2, &spec, bar)
+	if f2 != nil {
+		defer utils.SafeClose(f2.file)
+	}
+	if err != nil {
+		return JoinStats{}, err
+	}
+
+	if err := mergeJoin(f1, f2, w); err != nil {
+		return w.stats, err
+	}
+
+	for _, writer := range append([]*bufio.Writer{w.out}, w.unpaired[:]...) {
+		if writer == nil {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			return w.stats, err
+		}
+	}
+	return w.stats, nil
+}
+
+// mergeJoin steps through F1 one record at a time and through F2 one key
+// group at a time.
+func mergeJoin(f1, f2 *joinInput, w *joinWriter) error {
+	group, groupKey, err := f2.group()
+	if err != nil {
+		return err
+	}
+	matched := false
+	for f1.ok || len(group) > 0 {
+		c := 0
+		switch {
+		case !f1.ok:
+			c = 1
+		case len(group) == 0:
+			c = -1
+		default:
+			c = strings.Compare(f1.key, groupKey)
+		}
+
+		switch {
+		case c < 0:
+			if err := w.unpairedRecord(0, f1.line); err != nil {
+				return err
+			}
+			if err := f1.next(); err != nil {
+				return err
+			}
+		case c > 0:
+			if !matched {
+				for _, line := range group {
+					if err := w.unpairedRecord(1, line); err != nil {
+						return err
+					}
+				}
+			}
+			if group, groupKey, err = f2.group(); err != nil {
+				return err
+			}
+			matched = false
+		default:
+			for _, line := range group {
+				if err := w.paired(f1.line, line); err != nil {
+					return err
+				}
+			}
+			matched = true
+			if err := f1.next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package merging
+
+import (
+	"os"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func joinFixture(t *testing.T) (string, string, JoinSpec) {
+	t.Helper()
+	f1 := createTempFile(t, "A01;alice\nB02;bob\nC03;carol\n")
+	f2 := createTempFile(t, "T2;A01\nT1;B02\nT4;B02\nT3;E05\n")
+	t.Cleanup(func() {
+		os.Remove(f1)
+		os.Remove(f2)
+	})
+	spec := JoinSpec{
+		Keys1:     []sorting.SortKey{{Start: 0, Asc: true}},
+		Keys2:     []sorting.SortKey{{Start: 1, Asc: true}},
+		Delimiter: ";",
+	}
+	return f1, f2, spec
+}
+
+func runJoin(t *testing.T, f1, f2 string, spec JoinSpec) (string, JoinStats) {
+	t.Helper()
+	out := f1 + "_out.txt"
+	defer os.Remove(out)
+	stats, err := Join(out, f1, f2, spec)
+	require.NoError(t, err)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	return string(data), stats
+}
+
+func TestJoin_Types(t *testing.T) {
+	f1, f2, spec := joinFixture(t)
+
+	out, stats := runJoin(t, f1, f2, spec)
+	assert.Equal(t, "A01;alice;T2;A01\nB02;bob;T1;B02\nB02;bob;T4;B02\n", out)
+	assert.Equal(t, JoinStats{Paired: 3, Unpaired1: 1, Unpaired2: 1}, stats)
+
+	spec.Type = LeftJoin
+	out, _ = runJoin(t, f1, f2, spec)
+	assert.Equal(t, "A01;alice;T2;A01\nB02;bob;T1;B02\nB02;bob;T4;B02\nC03;carol;\n", out)
+
+	spec.Type = RightJoin
+	out, _ = runJoin(t, f1, f2, spec)
+	assert.Equal(t, "A01;alice;T2;A01\nB02;bob;T1;B02\nB02;bob;T4;B02\n;T3;E05\n", out)
+
+	spec.Type = FullJoin
+	out, _ = runJoin(t, f1, f2, spec)
+	assert.Equal(t, "A01;alice;T2;A01\nB02;bob;T1;B02\nB02;bob;T4;B02\nC03;carol;\n;T3;E05\n", out)
+}
+
+func TestJoin_ManyToManyAndReformat(t *testing.T) {
+	f1 := createTempFile(t, "k a\nk b\n")
+	f2 := createTempFile(t, "k 1\nk 2\n")
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+	reformat, err := sorting.ParseReformat("(F1:2,1,'-',F2:2,1)")
+	require.NoError(t, err)
+	keys := []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}
+
+	out, stats := runJoin(t, f1, f2, JoinSpec{Keys1: keys, Keys2: keys, Reformat: reformat})
+	assert.Equal(t, "a-1\na-2\nb-1\nb-2\n", out)
+	assert.Equal(t, 4, stats.Paired)
+}
+
+func TestJoin_UnpairedFiles(t *testing.T) {
+	f1, f2, spec := joinFixture(t)
+	spec.Unpaired1 = f1 + "_u1.txt"
+	spec.Unpaired2 = f1 + "_u2.txt"
+	defer os.Remove(spec.Unpaired1)
+	defer os.Remove(spec.Unpaired2)
+
+	runJoin(t, f1, f2, spec)
+
+	data, err := os.ReadFile(spec.Unpaired1)
+	require.NoError(t, err)
+	assert.Equal(t, "C03;carol\n", string(data))
+	data, err = os.ReadFile(spec.Unpaired2)
+	require.NoError(t, err)
+	assert.Equal(t, "T3;E05\n", string(data))
+}
+
+func TestJoin_FailsOnUnsortedInput(t *testing.T) {
+	f1, _, spec := joinFixture(t)
+	f2 := createTempFile(t, "T1;B02\nT2;A01\n")
+	defer os.Remove(f2)
+
+	_, err := Join(f1+"_out.txt", f1, f2, spec)
+	defer os.Remove(f1 + "_out.txt")
+	assert.ErrorContains(t, err, "is not sorted on its join keys: record 2 sorts before record 1")
+}
+
+func TestJoin_VariableRecordsNeedASeparator(t *testing.T) {
+	f1, f2, spec := joinFixture(t)
+	spec.Delimiter = ""
+
+	_, err := Join(f1+"_out.txt", f1, f2, spec)
+	assert.ErrorContains(t, err, "needs REFORMAT= or a delimiter")
+	assert.NoFileExists(t, f1+"_out.txt")
+}
+
+func TestJoin_FixedRecords(t *testing.T) {
+	f1 := createTempFile(t, "1a2b")
+	f2 := createTempFile(t, "2x3x")
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+	keys := []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}
+	spec := JoinSpec{Type: FullJoin, Keys1: keys, Keys2: keys, RecordType: "F", RecordLength: 2}
+
+	out, stats := runJoin(t, f1, f2, spec)
+	assert.Equal(t, "1a  \n2b2x\n  3x\n", out, "the missing side keeps the columns of the other")
+	assert.Equal(t, JoinStats{Paired: 1, Unpaired1: 1, Unpaired2: 1}, stats)
+}
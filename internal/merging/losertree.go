@@ -0,0 +1,128 @@
+package merging
+
+import "github.com/joeymeijers/xmsort/internal/sorting"
+
+// mergeItem is the current record of one merge input. The record's key is
+// encoded once when it is read from its file.
+type mergeItem struct {
+	line   string
+	key    string
+	seq    int64
+	fileID int
+}
+
+func newMergeItem(line string, seq int64, fileID int, opts sorting.Options) mergeItem {
+	return mergeItem{line: line, key: opts.Key(line), seq: seq, fileID: fileID}
+}
+
+// loserTree is a tournament tree over the current records of the merge
+// inputs. Each inner node holds the input that lost the match played there
+// and node 0 the overall winner, so replacing the winner's record replays a
+// single path to the root: about log2(k) comparisons per record, where a
+// binary heap needs about twice as many.
+type loserTree struct {
+	opts  sorting.Options
+	items []mergeItem // current record per input, by fileID
+	done  []bool      // input exhausted; loses every match
+	tree  []int       // tree[0] is the winner, tree[1:] the losers
+	live  int
+}
+
+// newLoserTree builds a tree over n inputs from the first record of each
+// input that has one. Inputs without an item start out exhausted.
+func newLoserTree(n int, items []mergeItem, opts sorting.Options) *loserTree {
+	t := &loserTree{
+		opts:  opts,
+		items: make([]mergeItem, n),
+		done:  make([]bool, n),
+		tree:  make([]int, max(n, 1)),
+	}
+	for i := range t.done {
+		t.done[i] = true
+	}
+	for _, item := range items {
+		t.items[item.fileID] = item
+		t.done[item.fileID] = false
+		t.live++
+	}
+	if n > 0 {
+		t.tree[0] = t.build(1)
+	}
+	return t
+}
+
+// build plays the matches below node and returns the subtree's winner. The
+// leaves, one per input, are numbered n..2n-1 after the inner nodes.
+func (t *loserTree) build(node int) int {
+	n := len(t.items)
+	if node >= n {
+		return node - n
+	}
+	winner, loser := t.build(2*node), t.build(2*node+1)
+	if t.less(loser, winner) {
+		winner, loser = loser, winner
+	}
+	t.tree[node] = loser
+	return winner
+}
+
+// less reports whether input i's record comes out before input j's. Equal
+// keys come out in fileID order, as chunk files are passed in input order.
+func (t *loserTree) less(i, j int) bool {
+	if t.done[i] || t.done[j] {
+		return !t.done[i]
+	}
+	a, b := &t.items[i], &t.items[j]
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return i < j
+}
+
+// replay plays the matches on the path of input i up to the root.
+func (t *loserTree) replay(i int) {
+	winner := i
+	for node := (i + len(t.items)) / 2; node > 0; node /= 2 {
+		if t.less(t.tree[node], winner) {
+			t.tree[node], winner = winner, t.tree[node]
+		}
+	}
+	t.tree[0] = winner
+}
+
+// Len returns the number of inputs that are not exhausted.
+func (t *loserTree) Len() int { return t.live }
+
+// Top returns the smallest current record. The tree must not be empty.
+func (t *loserTree) Top() mergeItem { return t.items[t.tree[0]] }
+
+// Next returns the record that follows item in the same input.
+func (t *loserTree) Next(item mergeItem, line string, seq int64) mergeItem {
+	return newMergeItem(line, seq, item.fileID, t.opts)
+}
+
+// Replace replaces the winner with the next record of its input.
+func (t *loserTree) Replace(next mergeItem) {
+	t.items[next.fileID] = next
+	t.replay(next.fileID)
+}
+
+// Pop marks the winner's input as exhausted.
+func (t *loserTree) Pop() {
+	i := t.tree[0]
+	t.done[i] = true
+	t.items[i] = mergeItem{}
+	t.live--
+	t.replay(i)
+}
+
+// Inputs returns the fileIDs of the inputs that are not exhausted.
+func (t *loserTree) Inputs() []int {
+	var ids []int
+	for i, done := range t.done {
+		if !done {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,78 @@
+package merging
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+)
+
+// drain merges sorted inputs through a loser tree and returns the records
+// as "line/fileID".
+func drain(inputs [][]string, opts sorting.Options) []string {
+	var items []mergeItem
+	pos := make([]int, len(inputs))
+	for i, in := range inputs {
+		if len(in) > 0 {
+			items = append(items, newMergeItem(in[0], 1, i, opts))
+			pos[i] = 1
+		}
+	}
+	tree := newLoserTree(len(inputs), items, opts)
+	var out []string
+	for tree.Len() > 0 {
+		item := tree.Top()
+		out = append(out, fmt.Sprintf("%s/%02d", item.line, item.fileID))
+		if in := inputs[item.fileID]; pos[item.fileID] < len(in) {
+			tree.Replace(tree.Next(item, in[pos[item.fileID]], 1))
+			pos[item.fileID]++
+		} else {
+			tree.Pop()
+		}
+	}
+	return out
+}
+
+func TestLoserTree_MergesInKeyThenInputOrder(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 2, Asc: true}}}
+	rng := rand.New(rand.NewSource(1))
+	for _, k := range []int{1, 2, 3, 7, 16} {
+		inputs := make([][]string, k)
+		var want []string
+		for i := range inputs {
+			// Some inputs stay empty; few distinct keys, so ties show
+			for range rng.Intn(30) {
+				inputs[i] = append(inputs[i], fmt.Sprintf("%02d", rng.Intn(20)))
+			}
+			sort.Strings(inputs[i])
+			for _, line := range inputs[i] {
+				want = append(want, fmt.Sprintf("%s/%02d", line, i))
+			}
+		}
+		sort.Strings(want) // same key: lower fileID first
+
+		assert.Equal(t, want, drain(inputs, opts), "%d inputs", k)
+	}
+}
+
+func TestLoserTree_Empty(t *testing.T) {
+	tree := newLoserTree(0, nil, sorting.Options{})
+	assert.Equal(t, 0, tree.Len())
+	assert.Empty(t, tree.Inputs())
+
+	tree = newLoserTree(3, nil, sorting.Options{})
+	assert.Equal(t, 0, tree.Len())
+}
+
+func TestLoserTree_Inputs(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	tree := newLoserTree(3, []mergeItem{newMergeItem("b", 1, 0, opts), newMergeItem("a", 1, 2, opts)}, opts)
+	assert.Equal(t, []int{0, 2}, tree.Inputs())
+	assert.Equal(t, 2, tree.Top().fileID)
+	tree.Pop()
+	assert.Equal(t, []int{0}, tree.Inputs())
+	assert.Equal(t, "b", tree.Top().line)
+}
@@ -2,10 +2,8 @@ package merging
 
 import (
 	"bufio"
-	"container/heap"
+	"fmt"
 	"io"
-	"os"
-	"strings"
 	"sync"
 
 	"github.com/cheggaaa/pb/v3"
@@ -13,52 +11,20 @@ import (
 	"github.com/joeymeijers/xmsort/internal/utils"
 )
 
-// heapItem represents an element in the heap used for merging chunks.
-type heapItem struct {
-	line      string
-	fileID    int
-	sortKeys  []sorting.SortKey
-	delimiter string
-	truncateSpaces bool
-	emptyNumbers   string
-}
-
-// minHeap is a min-heap of heapItems.
-type minHeap []heapItem
-
-func (h minHeap) Len() int { return len(h) }
-
-func (h minHeap) Less(i, j int) bool {
-	return sorting.CompareLines(h[i].line, h[j].line, h[i].sortKeys, h[i].delimiter, h[i].truncateSpaces, h[i].emptyNumbers)
-}
-
-func (h minHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-
-func (h *minHeap) Push(x any) {
-	*h = append(*h, x.(heapItem))
-}
-
-func (h *minHeap) Pop() any {
-	old := *h
-	n := len(old)
-	item := old[n-1]
-	*h = old[0 : n-1]
-	return item
-}
-
+// openChunkFiles opens the inputs of a merge and reads their first records.
+// Inputs without records are closed again and have no item.
 func openChunkFiles(
 	chunkFiles []string,
-	sortKeys []sorting.SortKey,
-	delimiter string,
-) ([]*bufio.Reader, []*os.File, []heapItem, error) {
-	readers := make([]*bufio.Reader, len(chunkFiles))
-	files := make([]*os.File, len(chunkFiles))
+	opts sorting.Options,
+) ([]recordSource, []io.Closer, []mergeItem, error) {
+	readers := make([]recordSource, len(chunkFiles))
+	files := make([]io.Closer, len(chunkFiles))
 	openSem := make(chan struct{}, utils.GetMaxOpenFiles())
 	var openWg sync.WaitGroup
 	var errOnce sync.Once
 	var exitErr error
 
-	itemChan := make(chan heapItem, len(chunkFiles))
+	itemChan := make(chan mergeItem, len(chunkFiles))
 
 	for i := range chunkFiles {
 		openWg.Add(1)
@@ -69,27 +35,21 @@ func openChunkFiles(
 				openWg.Done()
 			}()
 
-			f, err := os.Open(chunkFiles[i])
+			reader, f, err := openInput(chunkFiles[i], opts)
 			if err != nil {
 				errOnce.Do(func() { exitErr = err })
 				return
 			}
-			files[i] = f
-			readers[i] = bufio.NewReader(f)
-			line, err := readers[i].ReadString('\n')
-			if err != nil && err != io.EOF {
-				errOnce.Do(func() { exitErr = err })
-				return
-			}
-			line = strings.TrimRight(line, "\r\n")
-			if err != io.EOF || len(line) > 0 {
-				itemChan <- heapItem{
-					line:      line,
-					fileID:    i,
-					sortKeys:  sortKeys,
-					delimiter: delimiter,
+			line, seq, err := reader.Read()
+			if err != nil {
+				utils.SafeClose(f)
+				if err != io.EOF {
+					errOnce.Do(func() { exitErr = err })
 				}
+				return
 			}
+			files[i], readers[i] = f, reader
+			itemChan <- newMergeItem(line, seq, i, opts)
 		}(i)
 	}
 
@@ -98,93 +58,202 @@ func openChunkFiles(
 		close(itemChan)
 	}()
 
-	var initialHeapItems []heapItem
+	var initialItems []mergeItem
 	for item := range itemChan {
-		initialHeapItems = append(initialHeapItems, item)
+		initialItems = append(initialItems, item)
 	}
 
 	if exitErr != nil {
+		closeInputs(files)
 		return nil, nil, nil, exitErr
 	}
 
-	return readers, files, initialHeapItems, nil
+	return readers, files, initialItems, nil
 }
 
-func mergeHeapToOutput(
+// MergeMode controls how a merge treats its input and output files.
+type MergeMode struct {
+	KeepInputs  bool // leave exhausted inputs in place instead of removing them
+	VerifyOrder bool // fail on the first input record that is out of order
+	RunOutput   bool // write a run for a later merge instead of text output
+	// Parallel is the number of merges running side by side that share
+	// Options.Memory; 0 is 1.
+	Parallel int
+}
+
+// mergeToOutput merges the inputs into writer. With upper set, an input
+// counts as exhausted at its first record that does not sort before upper.
+func mergeToOutput(
 	writer *bufio.Writer,
-	readers []*bufio.Reader,
-	files []*os.File,
-	initialItems []heapItem,
+	readers []recordSource,
+	files []io.Closer,
+	initialItems []mergeItem,
 	bar *pb.ProgressBar,
 	chunkFiles []string,
+	opts sorting.Options,
+	mode MergeMode,
+	bufs mergeBuffers,
+	upper *mergeItem,
 ) error {
 	var errOnce sync.Once
 	var exitErr error
 
-	h := &minHeap{}
-	heap.Init(h)
+	tree := newLoserTree(len(readers), initialItems, opts)
+	sink, err := newRecordSink(writer, opts, mode.RunOutput)
+	if err != nil {
+		return err
+	}
+	// Every input with records is read ahead; it is stopped before its
+	// file is closed
+	prefetch := make([]*prefetchReader, len(readers))
 	for _, item := range initialItems {
-		heap.Push(h, item)
+		prefetch[item.fileID] = newPrefetchReader(readers[item.fileID], bufs.prefetch)
 	}
-	newline := utils.GetNewline()
-	for h.Len() > 0 {
-		item := heap.Pop(h).(heapItem)
-		_, err := writer.WriteString(item.line + newline)
+	for tree.Len() > 0 {
+		item := tree.Top()
+		err := sink.Add(item.line, item.key, item.seq)
 		if err != nil {
 			errOnce.Do(func() { exitErr = err })
 			break
 		}
 		bar.Increment()
+		if sink.Full() {
+			// LIMIT= reached: close this input with the others below
+			break
+		}
 
-		line, err := readers[item.fileID].ReadString('\n')
+		line, seq, err := prefetch[item.fileID].Read()
 		if err != nil && err != io.EOF {
 			errOnce.Do(func() { exitErr = err })
 			break
 		}
-		line = strings.TrimRight(line, "\r\n")
-		if err != io.EOF || len(line) > 0 {
-			heap.Push(h, heapItem{
-				line:      line,
-				fileID:    item.fileID,
-				sortKeys:  item.sortKeys,
-				delimiter: item.delimiter,
-			})
-		} else if err == io.EOF {
+		var next mergeItem
+		if err != io.EOF {
+			next = tree.Next(item, line, seq)
+			if upper != nil && next.key >= upper.key {
+				err = io.EOF
+			}
+		}
+		if err != io.EOF {
+			if mode.VerifyOrder && next.key < item.key {
+				// Text inputs number their records by line
+				errOnce.Do(func() {
+					exitErr = fmt.Errorf("input %s is not sorted: line %d sorts before line %d",
+						chunkFiles[item.fileID], seq, item.seq)
+				})
+				break
+			}
+			tree.Replace(next)
+		} else {
+			tree.Pop()
+			prefetch[item.fileID].Close()
 			utils.SafeClose(files[item.fileID])
-			utils.SafeRemove(chunkFiles[item.fileID]) // delete chunk immediately
+			if !mode.KeepInputs {
+				utils.SafeRemove(chunkFiles[item.fileID]) // delete chunk immediately
+			}
+		}
+	}
+	// Inputs still open after an error or LIMIT=
+	for _, id := range tree.Inputs() {
+		prefetch[id].Close()
+		utils.SafeClose(files[id])
+		if exitErr == nil && !mode.KeepInputs {
+			utils.SafeRemove(chunkFiles[id])
 		}
 	}
+	if err := sink.Close(); err != nil {
+		errOnce.Do(func() { exitErr = err })
+	}
 
 	utils.SafeFlush(writer)
-	bar.Finish()
 
 	return exitErr
 }
 
-func MergeChunks(outputFile string, chunkFiles []string, sortKeys []sorting.SortKey, delimiter string) error {
-	out, err := os.Create(outputFile)
+// closeOutput closes an output file and removes it when *err is set, so a
+// failed merge leaves no partial output behind.
+func closeOutput(out io.Closer, outputFile string, err *error) {
+	utils.SafeClose(out)
+	if *err != nil {
+		utils.RemoveOutput(outputFile)
+	}
+}
+
+// MergeChunks merges sorted chunk files into outputFile. The chunk files are
+// removed as soon as they are exhausted.
+func MergeChunks(outputFile string, chunkFiles []string, opts sorting.Options) error {
+	return Merge(outputFile, chunkFiles, opts, MergeMode{})
+}
+
+// Merge merges sorted runs or text files into outputFile as directed by mode.
+func Merge(outputFile string, chunkFiles []string, opts sorting.Options, mode MergeMode) (err error) {
+	out, err := utils.CreateOutput(outputFile)
 	if err != nil {
 		return err
 	}
-	defer utils.SafeClose(out)
+	defer closeOutput(out, outputFile, &err)
 
 	totalLines := 0
 	for _, f := range chunkFiles {
-		totalLines += utils.EstimateLineCount(f)
+		totalLines += utils.EstimateRecordCount(f)
 	}
-	bar := pb.StartNew(totalLines)
-	bar.SetWriter(os.Stdout)
+	bar := utils.StartProgressBar(totalLines)
+	defer bar.Finish()
 
-	readers, files, initialItems, err := openChunkFiles(chunkFiles, sortKeys, delimiter)
+	readers, files, initialItems, err := openChunkFiles(chunkFiles, opts)
 	if err != nil {
 		return err
 	}
 
-	writer := bufio.NewWriterSize(out, 16*1024*1024)
-	err = mergeHeapToOutput(writer, readers, files, initialItems, bar, chunkFiles)
+	return mergeWriteBehind(out, readers, files, initialItems, bar, chunkFiles, opts, mode, nil)
+}
+
+// WriteSorted writes an input that was sorted in memory to outputFile, with
+// the same output processing as the final merge.
+func WriteSorted(outputFile string, sorted *sorting.Sorted, opts sorting.Options) (err error) {
+	out, err := utils.CreateOutput(outputFile)
 	if err != nil {
 		return err
 	}
+	defer closeOutput(out, outputFile, &err)
 
-	return nil
+	writer := bufio.NewWriterSize(out, 4*1024*1024)
+	sink, err := newRecordSink(writer, opts, false)
+	if err != nil {
+		return err
+	}
+	if err := sorted.Each(sink.Add); err != nil {
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// mergeWriteBehind runs mergeToOutput with its output written behind to out.
+// Its buffers are taken from Options.Memory while it runs.
+func mergeWriteBehind(
+	out io.Writer,
+	readers []recordSource,
+	files []io.Closer,
+	initialItems []mergeItem,
+	bar *pb.ProgressBar,
+	chunkFiles []string,
+	opts sorting.Options,
+	mode MergeMode,
+	upper *mergeItem,
+) error {
+	share := opts.Memory.Total() / int64(max(mode.Parallel, 1))
+	bufs := newMergeBuffers(len(initialItems), share)
+	reserved := opts.Memory.Acquire(bufs.size(len(initialItems)))
+	defer opts.Memory.Release(reserved)
+
+	behind := newAsyncWriter(out, bufs.writeBehind)
+	writer := bufio.NewWriterSize(behind, outputBufferSize)
+	err := mergeToOutput(writer, readers, files, initialItems, bar, chunkFiles, opts, mode, bufs, upper)
+	if closeErr := behind.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
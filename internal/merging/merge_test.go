@@ -2,15 +2,22 @@ package merging
 
 import (
 	"bufio"
+	"io"
+	"log"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
 	"github.com/stretchr/testify/assert"
 )
 
+func init() {
+	utils.OverrideLogger(log.New(io.Discard, "", 0))
+}
+
 func createTempFile(t *testing.T, content string) string {
 	t.Helper()
 	tempfile, err := os.CreateTemp("", "chunk-*.txt")
@@ -32,7 +39,7 @@ func TestOpenChunkFiles(t *testing.T) {
 		{Start: 0, Length: 5, Numeric: false, Asc: false},
 	}
 
-	readers, files, items, err := openChunkFiles(chunks, keys, ",")
+	readers, files, items, err := openChunkFiles(chunks, sorting.Options{SortKeys: keys, Delimiter: ","})
 	assert.NoError(t, err)
 	assert.Len(t, readers, 2)
 	assert.Len(t, files, 2)
@@ -44,7 +51,22 @@ func TestOpenChunkFiles(t *testing.T) {
 
 }
 
-func TestMergeHeapToOutput(t *testing.T) {
+func TestOpenChunkFiles_ClosesEmptyInput(t *testing.T) {
+	chunk1 := createTempFile(t, "")
+	chunk2 := createTempFile(t, "carrot,3\n")
+	defer os.Remove(chunk1)
+	defer os.Remove(chunk2)
+
+	keys := []sorting.SortKey{{Start: 0, Length: 5, Asc: true}}
+	readers, files, items, err := openChunkFiles([]string{chunk1, chunk2}, sorting.Options{SortKeys: keys})
+	assert.NoError(t, err)
+	assert.Nil(t, files[0], "an input without records is closed")
+	assert.Nil(t, readers[0])
+	assert.Len(t, items, 1)
+	closeInputs(files)
+}
+
+func TestMergeToOutput(t *testing.T) {
 	content1 := "apple,10\nbanana,5"
 	content2 := "carrot,3\n"
 
@@ -54,14 +76,14 @@ func TestMergeHeapToOutput(t *testing.T) {
 	keys := []sorting.SortKey{
 		{Start: 0, Length: 5, Numeric: false, Asc: true},
 	}
-	readers, files, items, err := openChunkFiles([]string{file1, file2}, keys, ",")
+	readers, files, items, err := openChunkFiles([]string{file1, file2}, sorting.Options{SortKeys: keys, Delimiter: ","})
 	assert.NoError(t, err)
 
 	var builder strings.Builder
 	writer := bufio.NewWriter(&builder)
 	bar := pb.New(3)
 	bar.Start()
-	err = mergeHeapToOutput(writer, readers, files, items, bar, []string{file1, file2})
+	err = mergeToOutput(writer, readers, files, items, bar, []string{file1, file2}, sorting.Options{SortKeys: keys, Delimiter: ","}, MergeMode{}, newMergeBuffers(2, 0), nil)
 	assert.NoError(t, err)
 
 	assert.Contains(t, builder.String(), "apple")
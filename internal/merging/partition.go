@@ -0,0 +1,328 @@
+package merging
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+const (
+	// minPartitionRecords is the smallest key range worth its own worker.
+	minPartitionRecords = 1 << 16
+	// samplesPerPartition is how many samples each run contributes per
+	// partition; more samples even out the partition sizes.
+	samplesPerPartition = 64
+)
+
+// runSample is a sampled record of a run with the byte offset it starts at.
+// It stands for weight records from there on.
+type runSample struct {
+	mergeItem
+	offset int64
+	weight int
+}
+
+// MergeParallel merges sorted runs into outputFile like MergeChunks, but on
+// up to workers goroutines: splitter keys sampled from the runs cut the key
+// space into ranges, every worker merges one range from all runs into a part
+// file, and the parts are concatenated into the output. Options that depend
+// on the whole output (LIMIT=, SEQ=, a duplicates file) fall back to a
+// single merge. The runs are removed once they are merged.
+func MergeParallel(outputFile string, runFiles []string, opts sorting.Options, workers int, tempDir string) error {
+	if workers < 2 || !partitionable(opts) {
+		return MergeChunks(outputFile, runFiles, opts)
+	}
+	samples, records, err := sampleRuns(runFiles, opts, workers)
+	if err != nil {
+		return err
+	}
+	splitters := chooseSplitters(samples, records, workers)
+	if samples == nil || len(splitters) == 0 {
+		return MergeChunks(outputFile, runFiles, opts)
+	}
+
+	bar := utils.StartProgressBar(records)
+	defer bar.Finish()
+
+	parts := make([]string, len(splitters)+1)
+	mode := MergeMode{KeepInputs: true, Parallel: len(parts)}
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		exitErr error
+	)
+	for p := range parts {
+		parts[p] = filepath.Join(tempDir, fmt.Sprintf("part_%d.txt", p))
+		var lower, upper *mergeItem
+		if p > 0 {
+			lower = &splitters[p-1]
+		}
+		if p < len(splitters) {
+			upper = &splitters[p]
+		}
+		wg.Add(1)
+		go func(part string) {
+			defer wg.Done()
+			if err := mergePartition(part, runFiles, samples, lower, upper, bar, opts, mode); err != nil {
+				errOnce.Do(func() { exitErr = err })
+			}
+		}(parts[p])
+	}
+	wg.Wait()
+	if exitErr == nil {
+		exitErr = concatFiles(outputFile, parts)
+	}
+	for _, part := range parts {
+		_ = os.Remove(part)
+	}
+	if exitErr != nil {
+		return exitErr
+	}
+	for _, f := range runFiles {
+		utils.SafeRemove(f)
+	}
+	return nil
+}
+
+// partitionable reports whether key ranges can be merged independently.
+// Records that are deduplicated or summed together share a key and so a
+// range, but nothing may count records across the whole output.
+func partitionable(opts sorting.Options) bool {
+	return opts.Limit == 0 && opts.SeqNum == nil && opts.Discarded == nil
+}
+
+// sampleRuns samples the runs in parallel from their indexes and returns,
+// per run, records at about regular intervals, starting with its first
+// record, and the total number of records. The samples are nil when a run
+// has no index.
+func sampleRuns(runFiles []string, opts sorting.Options, workers int) ([][]runSample, int, error) {
+	samples := make([][]runSample, len(runFiles))
+	counts := make([]int, len(runFiles))
+	indexed := true
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errOnce sync.Once
+		exitErr error
+		sem     = make(chan struct{}, workers)
+	)
+	for i, f := range runFiles {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, f string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s, n, err := sampleRun(f, i, workers*samplesPerPartition, opts)
+			if err == utils.ErrNoRunIndex {
+				mu.Lock()
+				indexed = false
+				mu.Unlock()
+				return
+			}
+			if err != nil {
+				errOnce.Do(func() { exitErr = err })
+				return
+			}
+			samples[i], counts[i] = s, n
+		}(i, f)
+	}
+	wg.Wait()
+	if exitErr != nil {
+		return nil, 0, exitErr
+	}
+	if !indexed {
+		return nil, 0, nil
+	}
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return samples, total, nil
+}
+
+// sampleRun reads up to about want records of a run at the offsets in its
+// index, each standing for the records up to the next one, so the run is
+// not read through.
+func sampleRun(path string, fileID, want int, opts sorting.Options) ([]runSample, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer utils.SafeClose(f)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, records, err := utils.ReadRunIndex(f, info.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	every := max(len(entries)/want, 1)
+	var samples []runSample
+	for i := 0; i < len(entries); i += every {
+		entry := entries[i]
+		rr := utils.NewRunReaderAt(bufio.NewReader(io.NewSectionReader(f, entry.Offset, info.Size()-entry.Offset)), entry.Offset)
+		line, seq, err := rr.Read()
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading sample of %s: %w", path, err)
+		}
+		weight := records - entry.Record
+		if next := i + every; next < len(entries) {
+			weight = entries[next].Record - entry.Record
+		}
+		samples = append(samples, runSample{
+			mergeItem: newMergeItem(line, seq, fileID, opts),
+			offset:    entry.Offset,
+			weight:    int(weight),
+		})
+	}
+	return samples, int(records), nil
+}
+
+// chooseSplitters returns up to workers-1 distinct keys that cut the sampled
+// records into ranges of about equal size.
+func chooseSplitters(samples [][]runSample, records, workers int) []mergeItem {
+	parts := min(workers, records/minPartitionRecords)
+	if parts < 2 {
+		return nil
+	}
+	var all []runSample
+	for _, s := range samples {
+		all = append(all, s...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].key < all[j].key
+	})
+
+	var splitters []mergeItem
+	seen := 0
+	for _, s := range all {
+		if seen >= (len(splitters)+1)*records/parts {
+			last := len(splitters) - 1
+			if last < 0 || splitters[last].key < s.key {
+				splitters = append(splitters, s.mergeItem)
+				if len(splitters) == parts-1 {
+					break
+				}
+			}
+		}
+		seen += s.weight
+	}
+	return splitters
+}
+
+// mergePartition merges the records from lower up to, but not including,
+// upper from all runs into outputFile. Each run is read from its last sample
+// before lower, so only a few records are skipped.
+func mergePartition(
+	outputFile string,
+	runFiles []string,
+	samples [][]runSample,
+	lower, upper *mergeItem,
+	bar *pb.ProgressBar,
+	opts sorting.Options,
+	mode MergeMode,
+) error {
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer utils.SafeClose(out)
+
+	readers := make([]recordSource, len(runFiles))
+	files := make([]io.Closer, len(runFiles))
+	var items []mergeItem
+	for i, s := range samples {
+		if len(s) == 0 {
+			continue
+		}
+		start := 0
+		if lower != nil {
+			start = sort.Search(len(s), func(j int) bool {
+				return s[j].key >= lower.key
+			})
+			start = max(start-1, 0)
+		}
+		f, rr, item, err := openRange(runFiles[i], i, s[start].offset, lower, upper, opts)
+		if err != nil {
+			closeInputs(files)
+			return err
+		}
+		if item == nil {
+			utils.SafeClose(f)
+			continue
+		}
+		files[i], readers[i] = f, rr
+		items = append(items, *item)
+	}
+
+	return mergeWriteBehind(out, readers, files, items, bar, runFiles, opts, mode, upper)
+}
+
+// openRange opens a run at offset and reads up to its first record in the
+// range from lower up to upper. The record is nil when the range is empty.
+func openRange(
+	path string,
+	fileID int,
+	offset int64,
+	lower, upper *mergeItem,
+	opts sorting.Options,
+) (*os.File, *utils.RunReader, *mergeItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		utils.SafeClose(f)
+		return nil, nil, nil, err
+	}
+	rr := utils.NewRunReaderAt(bufio.NewReader(f), offset)
+	for {
+		line, seq, err := rr.Read()
+		if err == io.EOF {
+			return f, rr, nil, nil
+		}
+		if err != nil {
+			utils.SafeClose(f)
+			return nil, nil, nil, err
+		}
+		item := newMergeItem(line, seq, fileID, opts)
+		if lower != nil && item.key < lower.key {
+			continue
+		}
+		if upper != nil && item.key >= upper.key {
+			return f, rr, nil, nil
+		}
+		return f, rr, &item, nil
+	}
+}
+
+// concatFiles writes the parts one after the other to outputFile.
+func concatFiles(outputFile string, parts []string) (err error) {
+	out, err := utils.CreateOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	defer closeOutput(out, outputFile, &err)
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, f)
+		utils.SafeClose(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package merging
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRuns writes runs of lines with few distinct keys, each sorted on the
+// first four bytes and numbered across runs in input order.
+func writeRuns(t *testing.T, dir string, runs, perRun int) []string {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	var files []string
+	seq := int64(0)
+	for r := range runs {
+		lines := make([]string, perRun)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%04d run%d", rng.Intn(5000), r)
+		}
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i][:4] < lines[j][:4] })
+
+		name := filepath.Join(dir, fmt.Sprintf("run_%d.run", r))
+		f, err := os.Create(name)
+		require.NoError(t, err)
+		w := bufio.NewWriter(f)
+		rw, err := utils.NewRunWriter(w)
+		require.NoError(t, err)
+		for _, line := range lines {
+			seq++
+			require.NoError(t, rw.Write(line, seq))
+		}
+		require.NoError(t, rw.Close())
+		require.NoError(t, w.Flush())
+		require.NoError(t, f.Close())
+		files = append(files, name)
+	}
+	return files
+}
+
+func copyFiles(t *testing.T, files []string, dir string) []string {
+	t.Helper()
+	var copies []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		require.NoError(t, err)
+		name := filepath.Join(dir, filepath.Base(f))
+		require.NoError(t, os.WriteFile(name, data, 0644))
+		copies = append(copies, name)
+	}
+	return copies
+}
+
+func TestMergeParallel_MatchesSingleMerge(t *testing.T) {
+	keys := []sorting.SortKey{{Start: 0, Length: 4, Asc: true}}
+	for name, opts := range map[string]sorting.Options{
+		"stable": {SortKeys: keys, Stable: true},
+		"dedup":  {SortKeys: keys, Stable: true, RemoveDuplicates: true, DedupByKey: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			runs := writeRuns(t, dir, 5, 60000)
+			single := copyFiles(t, runs, t.TempDir())
+
+			want := filepath.Join(dir, "want.txt")
+			require.NoError(t, MergeChunks(want, single, opts))
+			got := filepath.Join(dir, "got.txt")
+			require.NoError(t, MergeParallel(got, runs, opts, 4, dir))
+
+			wantData, err := os.ReadFile(want)
+			require.NoError(t, err)
+			gotData, err := os.ReadFile(got)
+			require.NoError(t, err)
+			assert.True(t, string(wantData) == string(gotData), "output differs from a single merge")
+			for _, run := range runs {
+				assert.NoFileExists(t, run)
+			}
+			matches, _ := filepath.Glob(filepath.Join(dir, "part_*"))
+			assert.Empty(t, matches)
+		})
+	}
+}
+
+func TestSampleRuns_ReadsIndex(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 4, Asc: true}}}
+	runs := writeRuns(t, t.TempDir(), 2, 60000)
+
+	samples, records, err := sampleRuns(runs, opts, 4)
+	require.NoError(t, err)
+	assert.Equal(t, 120000, records)
+	for i, s := range samples {
+		require.Greater(t, len(s), 1, "run %d", i)
+		weight := 0
+		for _, sample := range s {
+			weight += sample.weight
+		}
+		assert.Equal(t, 60000, weight, "the samples stand for all records of run %d", i)
+		assert.Equal(t, int64(i*60000+1), s[0].seq, "a run is sampled from its first record")
+	}
+}
+
+func TestChooseSplitters(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	sample := func(line string, weight int) runSample {
+		return runSample{mergeItem: newMergeItem(line, 1, 0, opts), weight: weight}
+	}
+	samples := [][]runSample{
+		{sample("a", 100000), sample("c", 100000)},
+		{sample("b", 100000), sample("c", 100000)},
+	}
+
+	splitters := chooseSplitters(samples, 400000, 4)
+	var lines []string
+	for _, s := range splitters {
+		lines = append(lines, s.line)
+	}
+	// The two "c" samples cannot be split apart
+	assert.Equal(t, []string{"b", "c"}, lines)
+
+	assert.Empty(t, chooseSplitters(samples, minPartitionRecords, 4))
+}
+
+func TestPartitionable(t *testing.T) {
+	assert.True(t, partitionable(sorting.Options{}))
+	assert.False(t, partitionable(sorting.Options{Limit: 10}))
+	assert.False(t, partitionable(sorting.Options{SeqNum: &sorting.SeqNum{}}))
+	assert.True(t, partitionable(sorting.Options{Sum: &sorting.SumFields{}, RemoveDuplicates: true}),
+		"equal keys never span two ranges")
+}
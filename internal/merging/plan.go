@@ -0,0 +1,108 @@
+package merging
+
+const (
+	// minPrefetchBytes and minWriteBehindSize are the smallest read-ahead
+	// batch and write-behind buffer a merge short of memory is given; the
+	// largest are prefetchBytes and writeBehindSize.
+	minPrefetchBytes   = 64 << 10
+	minWriteBehindSize = 64 << 10
+	// inputBufferSize is the file buffer of an input and outputBufferSize
+	// the buffered writer in front of the write-behind buffers.
+	inputBufferSize  = 4096
+	outputBufferSize = 64 << 10
+	// minPassFanIn is the fan-in below which a pass runs fewer merges side
+	// by side rather than needing more passes.
+	minPassFanIn = 16
+)
+
+var (
+	// smallestBuffers are the buffers of a merge short of memory.
+	smallestBuffers = mergeBuffers{prefetch: minPrefetchBytes, writeBehind: minWriteBehindSize}
+	// MinMemory is the least memory a merge of two runs needs.
+	MinMemory = smallestBuffers.size(2)
+)
+
+// mergeBuffers are the buffer sizes of one merge.
+type mergeBuffers struct {
+	prefetch    int // bytes of one read-ahead batch
+	writeBehind int // bytes of each of the two output buffers
+}
+
+// size returns the memory a merge of inputs holds with these buffers: per
+// input the batches read ahead, the batch being merged and the file buffer,
+// and the output buffers.
+func (b mergeBuffers) size(inputs int) int64 {
+	perInput := int64((prefetchDepth+1)*b.prefetch + inputBufferSize)
+	return int64(inputs)*perInput + int64(2*b.writeBehind+outputBufferSize)
+}
+
+// newMergeBuffers returns the largest buffers up to prefetchBytes and
+// writeBehindSize with which a merge of inputs fits in memory bytes, but
+// never less than the smallest ones. Memory 0 is unlimited.
+func newMergeBuffers(inputs int, memory int64) mergeBuffers {
+	b := mergeBuffers{prefetch: prefetchBytes, writeBehind: writeBehindSize}
+	if memory <= 0 || b.size(inputs) <= memory {
+		return b
+	}
+	// Shrink all buffers alike, leaving out the fixed file buffers
+	fixed := mergeBuffers{}.size(inputs)
+	scale := float64(memory-fixed) / float64(b.size(inputs)-fixed)
+	b.prefetch = max(int(float64(b.prefetch)*scale), minPrefetchBytes)
+	b.writeBehind = max(int(float64(b.writeBehind)*scale), minWriteBehindSize)
+	return b
+}
+
+// MergePlanner decides how runs are merged in passes: how many runs one
+// merge reads, bounded by the open file limit and the memory for buffers,
+// and how many merges run side by side within those limits. Merges that
+// read many runs get smaller buffers, down to the smallest ones.
+type MergePlanner struct {
+	MaxOpenFiles int   // files all merges together may keep open
+	Memory       int64 // bytes all merges together may use for buffers
+	Workers      int   // merges that may run side by side
+}
+
+// FanIn returns the most runs each of parallel concurrent merges may read.
+func (p MergePlanner) FanIn(parallel int) int {
+	parallel = max(parallel, 1)
+	byFiles := p.MaxOpenFiles / parallel
+	byMemory := maxInputs(p.Memory / int64(parallel))
+	return max(min(byFiles, byMemory), 2)
+}
+
+// Final reports whether runs are few enough for the final merge.
+func (p MergePlanner) Final(runs int) bool {
+	return runs <= p.FanIn(1)
+}
+
+// Pass groups runs for one merge pass: it returns the sizes of groups of
+// consecutive runs, about equal in size, and how many of them to merge at
+// once.
+func (p MergePlanner) Pass(runs int) (groups []int, parallel int) {
+	maxFanIn := p.FanIn(1)
+	parallel = min(p.Workers, (runs+maxFanIn-1)/maxFanIn, maxFanIn/minPassFanIn)
+	parallel = max(parallel, 1)
+	fanIn := p.FanIn(parallel)
+
+	n := (runs + fanIn - 1) / fanIn
+	for i := range n {
+		groups = append(groups, (i+1)*runs/n-i*runs/n)
+	}
+	return groups, parallel
+}
+
+// FinalWorkers returns how many key ranges the final merge of runs can
+// merge side by side, as every range reads all runs.
+func (p MergePlanner) FinalWorkers(runs int) int {
+	runs = max(runs, 1)
+	byFiles := p.MaxOpenFiles / runs
+	byMemory := int(p.Memory / smallestBuffers.size(runs))
+	return max(min(p.Workers, byFiles, byMemory), 1)
+}
+
+// maxInputs returns how many inputs a merge can read with the smallest
+// buffers in memory bytes.
+func maxInputs(memory int64) int {
+	output := smallestBuffers.size(0)
+	return int((memory - output) / (smallestBuffers.size(1) - output))
+}
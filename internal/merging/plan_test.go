@@ -0,0 +1,61 @@
+package merging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePlanner_FanIn(t *testing.T) {
+	p := MergePlanner{MaxOpenFiles: 1000, Memory: smallestBuffers.size(100), Workers: 8}
+	assert.Equal(t, 100, p.FanIn(1), "memory bound")
+
+	p.Memory = 4 * smallestBuffers.size(25)
+	assert.Equal(t, 25, p.FanIn(4), "every merge also holds its output buffers")
+
+	p.MaxOpenFiles = 50
+	assert.Equal(t, 50, p.FanIn(1), "open file bound")
+	assert.Equal(t, 2, p.FanIn(100), "never below two")
+}
+
+func TestMergePlanner_PassesUntilFinal(t *testing.T) {
+	p := MergePlanner{MaxOpenFiles: 100, Memory: 1 << 40, Workers: 4}
+	runs := 25000
+	passes := 0
+	for !p.Final(runs) {
+		groups, parallel := p.Pass(runs)
+		assert.LessOrEqual(t, parallel, p.Workers)
+		total := 0
+		for _, g := range groups {
+			assert.LessOrEqual(t, g, p.FanIn(parallel))
+			assert.GreaterOrEqual(t, g, 2)
+			total += g
+		}
+		assert.Equal(t, runs, total, "every run is in a group")
+		assert.LessOrEqual(t, parallel*p.FanIn(parallel), p.MaxOpenFiles)
+		runs = len(groups)
+		passes++
+	}
+	assert.LessOrEqual(t, runs, 100)
+	assert.Equal(t, 2, passes)
+}
+
+func TestMergePlanner_FinalWorkers(t *testing.T) {
+	p := MergePlanner{MaxOpenFiles: 1000, Memory: 4 * smallestBuffers.size(100), Workers: 16}
+	assert.Equal(t, 4, p.FinalWorkers(100), "every key range reads all runs")
+	assert.Equal(t, 16, p.FinalWorkers(10))
+	assert.Equal(t, 1, p.FinalWorkers(900))
+}
+
+func TestNewMergeBuffers(t *testing.T) {
+	largest := mergeBuffers{prefetch: prefetchBytes, writeBehind: writeBehindSize}
+	assert.Equal(t, largest, newMergeBuffers(10, 0), "no memory limit")
+	assert.Equal(t, largest, newMergeBuffers(10, largest.size(10)))
+
+	memory := largest.size(10) / 4
+	bufs := newMergeBuffers(10, memory)
+	assert.LessOrEqual(t, bufs.size(10), memory, "shrunk to fit")
+	assert.Greater(t, bufs.prefetch, minPrefetchBytes)
+
+	assert.Equal(t, smallestBuffers, newMergeBuffers(10, MinMemory), "never below the smallest")
+}
@@ -0,0 +1,142 @@
+package merging
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// SetOp is a set operation over files sorted on the same keys.
+type SetOp int
+
+const (
+	Union     SetOp = iota // keys found in any file
+	Intersect              // keys found in every file
+	Except                 // keys of the first file found in no other file
+)
+
+func (op SetOp) String() string {
+	return [...]string{"UNION", "INTERSECT", "EXCEPT"}[op]
+}
+
+// ParseSetOp parses a SET= value.
+func ParseSetOp(val string) (SetOp, error) {
+	switch val {
+	case "UNION":
+		return Union, nil
+	case "INTERSECT":
+		return Intersect, nil
+	case "EXCEPT":
+		return Except, nil
+	}
+	return Union, fmt.Errorf("unknown set operation %q (UNION, INTERSECT or EXCEPT)", val)
+}
+
+// SetOperation merges input files sorted on the job's keys and writes one
+// record per key that op selects: the first record with that key in input
+// order. Records are the same when their encoded keys are equal. With
+// counts every record is prefixed with the number of records sharing its
+// key across all inputs and a tab. The inputs hold records in the job's
+// layout (RT= and RL=), STDIO reads standard input. They are left in place,
+// and the operation fails on the first input record that is out of order.
+func SetOperation(outputFile string, inputFiles []string, opts sorting.Options, op SetOp, counts bool) (written int, err error) {
+	out, err := utils.CreateOutput(outputFile)
+	if err != nil {
+		return 0, err
+	}
+	defer closeOutput(out, outputFile, &err)
+
+	totalLines := 0
+	for _, f := range inputFiles {
+		totalLines += utils.EstimateRecordCount(f)
+	}
+	bar := utils.StartProgressBar(totalLines)
+	defer bar.Finish()
+
+	readers, files, initialItems, err := openChunkFiles(inputFiles, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer closeInputs(files)
+
+	tree := newLoserTree(len(inputFiles), initialItems, opts)
+
+	writer := bufio.NewWriterSize(out, 16*1024*1024)
+	newline := utils.GetNewline()
+
+	// One group holds the records of all inputs that share a key
+	var (
+		first   mergeItem
+		records int
+		inFiles = make([]bool, len(inputFiles))
+	)
+	emit := func() error {
+		found := 0
+		for _, in := range inFiles {
+			if in {
+				found++
+			}
+		}
+		keep := false
+		switch op {
+		case Union:
+			keep = true
+		case Intersect:
+			keep = found == len(inputFiles)
+		case Except:
+			keep = inFiles[0] && found == 1
+		}
+		if !keep {
+			return nil
+		}
+		written++
+		if counts {
+			if _, err := fmt.Fprintf(writer, "%d\t", records); err != nil {
+				return err
+			}
+		}
+		_, err := writer.WriteString(first.line + newline)
+		return err
+	}
+
+	for tree.Len() > 0 {
+		item := tree.Top()
+		bar.Increment()
+		if records > 0 && first.key != item.key {
+			if err := emit(); err != nil {
+				return written, err
+			}
+			records = 0
+			clear(inFiles)
+		}
+		if records == 0 {
+			first = item
+		}
+		records++
+		inFiles[item.fileID] = true
+
+		line, seq, err := readers[item.fileID].Read()
+		if err == io.EOF {
+			tree.Pop()
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		next := tree.Next(item, line, seq)
+		if next.key < item.key {
+			return written, fmt.Errorf("input %s is not sorted: line %d sorts before line %d",
+				inputFiles[item.fileID], seq, item.seq)
+		}
+		tree.Replace(next)
+	}
+	if records > 0 {
+		if err := emit(); err != nil {
+			return written, err
+		}
+	}
+	return written, writer.Flush()
+}
@@ -0,0 +1,85 @@
+package merging
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOperation(t *testing.T) {
+	f1 := createTempFile(t, "a 1\nb 1\nb 2\nc 1\n")
+	f2 := createTempFile(t, "b 3\nc 2\nd 1\n")
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	out := f1 + "_out.txt"
+	defer os.Remove(out)
+
+	tests := []struct {
+		op     SetOp
+		counts bool
+		want   string
+	}{
+		{Union, false, "a 1\nb 1\nc 1\nd 1\n"},
+		{Intersect, true, "3\tb 1\n2\tc 1\n"},
+		{Except, false, "a 1\n"},
+	}
+	for _, tt := range tests {
+		written, err := SetOperation(out, []string{f1, f2}, opts, tt.op, tt.counts)
+		require.NoError(t, err, tt.op)
+		data, err := os.ReadFile(out)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, string(data), tt.op)
+		assert.Equal(t, strings.Count(tt.want, "\n"), written, tt.op)
+	}
+	// The inputs are kept
+	assert.FileExists(t, f1)
+	assert.FileExists(t, f2)
+}
+
+func TestSetOperation_FailsOnUnsortedInput(t *testing.T) {
+	f1 := createTempFile(t, "a\nc\nb\n")
+	f2 := createTempFile(t, "a\n")
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	out := f1 + "_out.txt"
+	defer os.Remove(out)
+
+	_, err := SetOperation(out, []string{f1, f2}, opts, Union, false)
+	assert.ErrorContains(t, err, "line 3 sorts before line 2")
+}
+
+func TestSetOperation_FixedRecordsAndStdin(t *testing.T) {
+	f1 := createTempFile(t, "aabbcc")
+	f2 := createTempFile(t, "bbdd")
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+
+	stdin, err := os.Open(f2)
+	require.NoError(t, err)
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	opts := sorting.Options{
+		SortKeys:     []sorting.SortKey{{Start: 0, Length: 2, Asc: true}},
+		RecordType:   "F",
+		RecordLength: 2,
+	}
+	out := f1 + "_out.txt"
+	defer os.Remove(out)
+
+	written, err := SetOperation(out, []string{f1, utils.STDIO}, opts, Intersect, false)
+	require.NoError(t, err)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "bb\n", string(data))
+	assert.Equal(t, 1, written)
+}
@@ -0,0 +1,113 @@
+package merging
+
+import (
+	"bufio"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// recordSink receives merged records in sorted order and writes them out,
+// removing duplicates and summing equal keys on the way when the job asks
+// for it. Records go to a
+// run when a later merge reads them, otherwise to plain text lines.
+type recordSink struct {
+	writer  *bufio.Writer
+	run     *utils.RunWriter
+	newline string
+	dedup   *sorting.Deduplicator
+	summer  *sorting.Summer
+	outrec  *sorting.Reformat
+	seq     *sorting.Sequencer
+	delim   string
+	limit   int64
+	written int64
+}
+
+func newRecordSink(writer *bufio.Writer, opts sorting.Options, runOutput bool) (*recordSink, error) {
+	s := &recordSink{
+		writer:  writer,
+		newline: utils.GetNewline(),
+		limit:   opts.Limit,
+	}
+	if runOutput {
+		run, err := utils.NewRunWriter(writer)
+		if err != nil {
+			return nil, err
+		}
+		s.run = run
+	} else {
+		s.outrec = opts.Outrec
+		s.delim = opts.Delimiter
+		if opts.SeqNum != nil {
+			s.seq = sorting.NewSequencer(opts.SeqNum, opts.Delimiter)
+		}
+	}
+	if opts.Sum != nil {
+		s.summer = sorting.NewSummer(opts, s.write)
+	}
+	if opts.RemoveDuplicates {
+		s.dedup = sorting.NewDeduplicator(opts, s.sum)
+	}
+	return s, nil
+}
+
+// Add passes the next merged record and its encoded key through the sink.
+func (s *recordSink) Add(line, key string, seq int64) error {
+	if s.dedup != nil {
+		return s.dedup.Add(line, key, seq)
+	}
+	return s.sum(line, key, seq)
+}
+
+// Close writes out any record still held back and ends a run. It does not
+// flush the writer.
+func (s *recordSink) Close() error {
+	if s.dedup != nil {
+		if err := s.dedup.Flush(); err != nil {
+			return err
+		}
+	}
+	if s.summer != nil {
+		if err := s.summer.Flush(); err != nil {
+			return err
+		}
+	}
+	if s.run != nil {
+		return s.run.Close()
+	}
+	return nil
+}
+
+// Full reports whether the sink has written LIMIT= records, so the merge
+// can stop reading.
+func (s *recordSink) Full() bool {
+	return s.limit > 0 && s.written >= s.limit
+}
+
+func (s *recordSink) sum(line, key string, seq int64) error {
+	if s.summer != nil {
+		return s.summer.Add(line, key, seq)
+	}
+	return s.write(line, key, seq)
+}
+
+func (s *recordSink) write(line, _ string, seq int64) error {
+	if s.Full() {
+		// Held back by dedup or SUM= when the merge stopped
+		return nil
+	}
+	s.written++
+	if s.run != nil {
+		return s.run.Write(line, seq)
+	}
+	out := line
+	if s.outrec != nil {
+		out = s.outrec.Apply(line, s.delim)
+	}
+	if s.seq != nil {
+		out = s.seq.Number(line, out)
+	}
+	_, err := s.writer.WriteString(out + s.newline)
+	return err
+}
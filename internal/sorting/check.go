@@ -0,0 +1,76 @@
+package sorting
+
+import (
+	"io"
+)
+
+// CheckResult is the outcome of CheckSorted. The first violation is a pair
+// of consecutive records where Record sorts before Previous. Line numbers
+// are 1-based and count records within their own input file.
+type CheckResult struct {
+	Records    int
+	Violations int
+
+	File   string
+	Line   int
+	Record string
+
+	PreviousFile string
+	PreviousLine int
+	Previous     string
+}
+
+// Sorted reports whether no record was found out of order.
+func (r CheckResult) Sorted() bool {
+	return r.Violations == 0
+}
+
+// CheckSorted streams the inputs once and checks that every record is in
+// order on the sort keys. It stops at the first violation unless countAll is
+// set, in which case it reads everything and counts all violations. Records
+// of consecutive inputs are checked as one stream.
+func CheckSorted(inputFiles []string, opts Options, countAll bool) (CheckResult, error) {
+	reader := NewRecordReader(inputFiles, opts.RecordType, opts.RecordLength)
+	defer reader.Close()
+
+	var (
+		result       CheckResult
+		previous     string
+		previousLine int
+		lineNumber   int
+		lastSource   = -1
+	)
+	for {
+		line, source, err := reader.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		previousSource := lastSource
+		if source != lastSource {
+			lineNumber = 0
+			lastSource = source
+		}
+		lineNumber++
+		result.Records++
+
+		if result.Records > 1 && opts.Less(line, previous) {
+			result.Violations++
+			if result.Violations == 1 {
+				result.File = inputFiles[source]
+				result.Line = lineNumber
+				result.Record = line
+				result.PreviousFile = inputFiles[previousSource]
+				result.PreviousLine = previousLine
+				result.Previous = previous
+			}
+			if !countAll {
+				return result, nil
+			}
+		}
+		previous = line
+		previousLine = lineNumber
+	}
+}
@@ -0,0 +1,53 @@
+package sorting_test
+
+import (
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSorted_Sorted(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "a\nb\nb\n")
+	b := writeInput(t, dir, "b.txt", "c\n")
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+
+	result, err := sorting.CheckSorted([]string{a, b}, opts, true)
+	require.NoError(t, err)
+	assert.True(t, result.Sorted())
+	assert.Equal(t, 4, result.Records)
+}
+
+func TestCheckSorted_FirstViolation(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "a\nc\nb\nd\na\n")
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+
+	result, err := sorting.CheckSorted([]string{a}, opts, false)
+	require.NoError(t, err)
+	assert.False(t, result.Sorted())
+	assert.Equal(t, 1, result.Violations)
+	assert.Equal(t, 3, result.Line)
+	assert.Equal(t, "b", result.Record)
+	assert.Equal(t, "c", result.Previous)
+	assert.Equal(t, 2, result.PreviousLine)
+	assert.Equal(t, 3, result.Records)
+}
+
+func TestCheckSorted_CountAll(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "a\nc\n")
+	b := writeInput(t, dir, "b.txt", "b\nd\na\n")
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+
+	result, err := sorting.CheckSorted([]string{a, b}, opts, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Violations)
+	assert.Equal(t, b, result.File)
+	assert.Equal(t, 1, result.Line)
+	assert.Equal(t, a, result.PreviousFile)
+	assert.Equal(t, 2, result.PreviousLine)
+	assert.Equal(t, 5, result.Records)
+}
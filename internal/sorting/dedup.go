@@ -0,0 +1,222 @@
+package sorting
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// Deduplicator removes duplicates from a stream of sorted records, each
+// passed with its encoded key (Options.Key). Records with equal keys must
+// arrive in input order, so the first (or with
+// KeepLast, the last) duplicate is kept. With DedupByKey equal keys are
+// enough; otherwise only identical records are duplicates, and as they need
+// not be next to each other, the records of each key are remembered until
+// the key changes. That memory is charged to Options.Memory, so other work
+// waits for it, but one key shared by more distinct records than fit in
+// MEM= still takes more than MEM=; RD=KEY or a finer key avoids that.
+// Removed records go to Options.Discarded when it is set.
+type Deduplicator struct {
+	opts    Options
+	emit    func(line, key string, seq int64) error
+	last    Record
+	lastKey string
+	hasLast bool
+
+	// Whole records only: the index in group of the record kept for each
+	// line so far, and with KeepLast the records of the key held back
+	seen  map[string]int
+	group []Record
+	// Bytes held for the key and the part charged to Options.Memory
+	held, charged int64
+}
+
+const (
+	// seenEntrySize is the memory of a remembered record besides its bytes,
+	// and recordSize that of a record held back by KeepLast.
+	seenEntrySize = 64
+	recordSize    = int(unsafe.Sizeof(Record{}))
+	// dedupChargeStep is the least charged to the budget at a time.
+	dedupChargeStep = 64 << 10
+	// maxReusedGroup is the most records whose map is kept for the next key.
+	maxReusedGroup = 1024
+)
+
+func NewDeduplicator(opts Options, emit func(line, key string, seq int64) error) *Deduplicator {
+	return &Deduplicator{opts: opts, emit: emit}
+}
+
+// Add passes a record on unless it duplicates a record before it.
+func (d *Deduplicator) Add(line, key string, seq int64) error {
+	sameKey := d.hasLast && d.lastKey == key
+	if !d.opts.DedupByKey {
+		return d.addRecord(Record{Line: line, Seq: seq}, key, sameKey)
+	}
+	if d.opts.KeepLast {
+		// Hold the record back until the next one shows whether it was the last
+		if d.hasLast {
+			var err error
+			if sameKey {
+				err = d.discard(d.last)
+			} else {
+				err = d.emit(d.last.Line, d.lastKey, d.last.Seq)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		d.last, d.lastKey, d.hasLast = Record{Line: line, Seq: seq}, key, true
+		return nil
+	}
+	if sameKey {
+		return d.discard(Record{Line: line, Seq: seq})
+	}
+	d.last, d.lastKey, d.hasLast = Record{Line: line, Seq: seq}, key, true
+	return d.emit(line, key, seq)
+}
+
+// addRecord removes records identical to one before them with the same key.
+func (d *Deduplicator) addRecord(record Record, key string, sameKey bool) error {
+	if !sameKey {
+		if err := d.endGroup(); err != nil {
+			return err
+		}
+	}
+	d.last, d.lastKey, d.hasLast = record, key, true
+	if d.seen == nil {
+		d.seen = make(map[string]int)
+	}
+	i, duplicate := d.seen[record.Line]
+	if !d.opts.KeepLast {
+		if duplicate {
+			return d.discard(record)
+		}
+		d.seen[record.Line] = 0
+		d.hold(len(record.Line) + seenEntrySize)
+		return d.emit(record.Line, key, record.Seq)
+	}
+	if duplicate {
+		if err := d.discard(d.group[i]); err != nil {
+			return err
+		}
+	}
+	if !duplicate {
+		d.hold(len(record.Line) + seenEntrySize)
+	}
+	d.seen[record.Line] = len(d.group)
+	d.group = append(d.group, record)
+	d.hold(recordSize)
+	return nil
+}
+
+// hold counts n more bytes for the key, charging them to Options.Memory in
+// steps.
+func (d *Deduplicator) hold(n int) {
+	d.held += int64(n)
+	if d.held > d.charged {
+		step := max(d.held-d.charged, dedupChargeStep)
+		d.opts.Memory.Charge(step)
+		d.charged += step
+	}
+}
+
+// endGroup passes on the records of a key held back by KeepLast, each the
+// last of its identical records, and forgets the key's records.
+func (d *Deduplicator) endGroup() error {
+	for i, record := range d.group {
+		if d.seen[record.Line] != i {
+			continue
+		}
+		if err := d.emit(record.Line, d.lastKey, record.Seq); err != nil {
+			return err
+		}
+	}
+	if len(d.seen) > maxReusedGroup {
+		// Let a large key's memory go rather than keep it for small ones
+		d.seen, d.group = nil, nil
+	} else {
+		clear(d.seen)
+		d.group = d.group[:0]
+	}
+	d.opts.Memory.Release(d.charged)
+	d.held, d.charged = 0, 0
+	return nil
+}
+
+// Flush passes on the records held back by KeepLast.
+func (d *Deduplicator) Flush() error {
+	if !d.opts.DedupByKey {
+		return d.endGroup()
+	}
+	if d.opts.KeepLast && d.hasLast {
+		d.hasLast = false
+		return d.emit(d.last.Line, d.lastKey, d.last.Seq)
+	}
+	return nil
+}
+
+func (d *Deduplicator) discard(record Record) error {
+	if d.opts.Discarded == nil {
+		return nil
+	}
+	return d.opts.Discarded.Write(record)
+}
+
+// DiscardLog receives the records removed as duplicates (XSUM=). It is
+// shared by the chunk workers and concurrent merges, so records are logged
+// in the order they are removed, not in sorted order.
+type DiscardLog struct {
+	mu          sync.Mutex
+	file        io.WriteCloser
+	writer      *bufio.Writer
+	newline     string
+	lineNumbers bool
+	count       int
+}
+
+// CreateDiscardLog creates the log file. With lineNumbers every record is
+// prefixed with its input record number and a tab.
+func CreateDiscardLog(filename string, lineNumbers bool) (*DiscardLog, error) {
+	file, err := utils.CreateOutput(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &DiscardLog{
+		file:        file,
+		writer:      bufio.NewWriter(file),
+		newline:     utils.GetNewline(),
+		lineNumbers: lineNumbers,
+	}, nil
+}
+
+func (l *DiscardLog) Write(record Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if l.lineNumbers {
+		if _, err := fmt.Fprintf(l.writer, "%d\t", record.Seq); err != nil {
+			return err
+		}
+	}
+	_, err := l.writer.WriteString(record.Line + l.newline)
+	return err
+}
+
+// Count returns the number of records logged so far.
+func (l *DiscardLog) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func (l *DiscardLog) Close() error {
+	if err := l.writer.Flush(); err != nil {
+		utils.SafeClose(l.file)
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,125 @@
+package sorting_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dedupAll(t *testing.T, opts sorting.Options, lines []string) []string {
+	t.Helper()
+	var result []string
+	dedup := sorting.NewDeduplicator(opts, func(line, _ string, seq int64) error {
+		result = append(result, line)
+		return nil
+	})
+	for i, line := range lines {
+		assert.NoError(t, dedup.Add(line, opts.Key(line), int64(i+1)))
+	}
+	assert.NoError(t, dedup.Flush())
+	return result
+}
+
+func TestDeduplicator_WholeRecord(t *testing.T) {
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+	}
+	result := dedupAll(t, opts, []string{"a1", "a1", "a2", "b1", "b1"})
+	assert.Equal(t, []string{"a1", "a2", "b1"}, result)
+}
+
+func TestDeduplicator_ByKeyKeepFirst(t *testing.T) {
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+		DedupByKey:       true,
+	}
+	result := dedupAll(t, opts, []string{"a1", "a2", "b1", "c1", "c2"})
+	assert.Equal(t, []string{"a1", "b1", "c1"}, result)
+}
+
+func TestDeduplicator_ByKeyKeepLast(t *testing.T) {
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+		DedupByKey:       true,
+		KeepLast:         true,
+	}
+	result := dedupAll(t, opts, []string{"a1", "a2", "b1", "c1", "c2"})
+	assert.Equal(t, []string{"a2", "b1", "c2"}, result)
+}
+
+func TestDeduplicator_WholeRecordKeepsInputOrder(t *testing.T) {
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+	}
+	lines := []string{"a 3", "a 1", "a 2", "a 1", "b 1", "a 1"}
+	assert.Equal(t, []string{"a 3", "a 1", "a 2", "b 1", "a 1"}, dedupAll(t, opts, lines),
+		"identical records need not be adjacent within a key")
+
+	opts.KeepLast = true
+	assert.Equal(t, []string{"a 3", "a 2", "a 1", "b 1", "a 1"}, dedupAll(t, opts, lines))
+}
+
+func TestDeduplicator_ChargesKeyToBudget(t *testing.T) {
+	budget := utils.NewMemoryBudget(1 << 20)
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+		Memory:           budget,
+	}
+	dedup := sorting.NewDeduplicator(opts, func(string, string, int64) error { return nil })
+	for i := range 1000 {
+		line := fmt.Sprintf("a %04d", i)
+		require.NoError(t, dedup.Add(line, opts.Key(line), int64(i+1)))
+	}
+
+	acquired := make(chan int64)
+	go func() { acquired <- budget.Acquire(budget.Total()) }()
+	select {
+	case <-acquired:
+		t.Fatal("the records of the key were not charged")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, dedup.Flush())
+	budget.Release(<-acquired)
+}
+
+func TestOptionsCompare_KeysOnly(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+	assert.Equal(t, 0, opts.Compare("a2", "a1"))
+
+	opts.RemoveDuplicates = true
+	assert.Equal(t, 0, opts.Compare("a2", "a1"), "whole-record dedup keeps input order")
+}
+
+func TestDeduplicator_DiscardLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "xsum.txt")
+	discarded, err := sorting.CreateDiscardLog(filename, true)
+	require.NoError(t, err)
+
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+		DedupByKey:       true,
+		KeepLast:         true,
+		Discarded:        discarded,
+	}
+	result := dedupAll(t, opts, []string{"a1", "a2", "a3", "b1"})
+	assert.Equal(t, []string{"a3", "b1"}, result)
+	require.NoError(t, discarded.Close())
+	assert.Equal(t, 2, discarded.Count())
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "1\ta1\n2\ta2\n", string(data))
+}
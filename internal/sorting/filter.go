@@ -0,0 +1,256 @@
+package sorting
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter is a compiled INCLUDE= or OMIT= condition. Conditions compare a
+// field with a constant and are combined with AND and OR, AND binding
+// tighter, and grouped with parentheses:
+//
+//	INCLUDE=(0,2,EQ,'01',AND,(10,5,GT,100,OR,10,5,LT,-100))
+//
+// A field is start,length as in sort keys: a 0-based position, or a column
+// when a delimiter is set. Operators are EQ, NE, GT, GE, LT and LE. Quoted
+// constants ('text' or C'text') compare as text, others as numbers; a field
+// that is not a number never matches a numeric constant.
+type Filter struct {
+	cond condition
+	omit bool
+}
+
+// ParseFilter compiles a condition. With omit the filter drops the records
+// that match instead of keeping them.
+func ParseFilter(expr string, omit bool) (*Filter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in condition", p.tokens[p.pos])
+	}
+	return &Filter{cond: cond, omit: omit}, nil
+}
+
+// Keep reports whether a record passes the filter.
+func (f *Filter) Keep(line string, delimiter string, truncateSpaces bool) bool {
+	return f.cond.match(line, delimiter, truncateSpaces) != f.omit
+}
+
+type condition interface {
+	match(line, delimiter string, truncateSpaces bool) bool
+}
+
+type andCondition []condition
+
+func (c andCondition) match(line, delimiter string, truncateSpaces bool) bool {
+	for _, sub := range c {
+		if !sub.match(line, delimiter, truncateSpaces) {
+			return false
+		}
+	}
+	return true
+}
+
+type orCondition []condition
+
+func (c orCondition) match(line, delimiter string, truncateSpaces bool) bool {
+	for _, sub := range c {
+		if sub.match(line, delimiter, truncateSpaces) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareCondition compares one field with a constant.
+type compareCondition struct {
+	field   SortKey
+	op      string
+	text    string
+	number  float64
+	numeric bool
+}
+
+func (c compareCondition) match(line, delimiter string, truncateSpaces bool) bool {
+	value := ExtractField(line, c.field, delimiter, truncateSpaces)
+	var cmp int
+	if c.numeric {
+		num, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case num < c.number:
+			cmp = -1
+		case num > c.number:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(value, c.text)
+	}
+
+	switch c.op {
+	case "EQ":
+		return cmp == 0
+	case "NE":
+		return cmp != 0
+	case "GT":
+		return cmp > 0
+	case "GE":
+		return cmp >= 0
+	case "LT":
+		return cmp < 0
+	default: // LE
+		return cmp <= 0
+	}
+}
+
+// tokenizeFilter splits a condition into parentheses, quoted constants and
+// words. Commas and spaces only separate tokens.
+func tokenizeFilter(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ',' || c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'' || ((c == 'C' || c == 'c') && i+1 < len(expr) && expr[i+1] == '\''):
+			start := strings.IndexByte(expr[i:], '\'') + i
+			end := strings.IndexByte(expr[start+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated text constant in condition")
+			}
+			tokens = append(tokens, expr[start:start+end+2])
+			i = start + end + 2
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(", \t()'", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("condition is incomplete")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && strings.ToUpper(p.tokens[p.pos]) == keyword
+}
+
+func (p *filterParser) parseOr() (condition, error) {
+	cond, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := orCondition{cond}
+	for p.peekKeyword("OR") {
+		p.pos++
+		if cond, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		or = append(or, cond)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) parseAnd() (condition, error) {
+	cond, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	and := andCondition{cond}
+	for p.peekKeyword("AND") {
+		p.pos++
+		if cond, err = p.parseTerm(); err != nil {
+			return nil, err
+		}
+		and = append(and, cond)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *filterParser) parseTerm() (condition, error) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos] == "(" {
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("missing ) in condition")
+		}
+		return cond, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (condition, error) {
+	var words [4]string
+	for i := range words {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		words[i] = tok
+	}
+
+	var cond compareCondition
+	start, err := strconv.Atoi(words[0])
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid field start %q in condition", words[0])
+	}
+	length, err := strconv.Atoi(words[1])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid field length %q in condition", words[1])
+	}
+	cond.field = SortKey{Start: start, Length: length}
+
+	cond.op = strings.ToUpper(words[2])
+	switch cond.op {
+	case "EQ", "NE", "GT", "GE", "LT", "LE":
+	default:
+		return nil, fmt.Errorf("invalid operator %q in condition", words[2])
+	}
+
+	constant := words[3]
+	if quote := strings.IndexByte(constant, '\''); quote >= 0 {
+		cond.text = constant[quote+1 : len(constant)-1]
+	} else {
+		cond.number, err = strconv.ParseFloat(constant, 64)
+		if err != nil {
+			return nil, fmt.Errorf("constant %q must be a number or quoted text", constant)
+		}
+		cond.numeric = true
+	}
+	return cond, nil
+}
@@ -0,0 +1,68 @@
+package sorting_test
+
+import (
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_TextAndNumber(t *testing.T) {
+	filter, err := sorting.ParseFilter("(0,2,EQ,'01',AND,3,4,GT,100)", false)
+	require.NoError(t, err)
+
+	assert.True(t, filter.Keep("01 0150", "", false))
+	assert.False(t, filter.Keep("01 0050", "", false))
+	assert.False(t, filter.Keep("02 0150", "", false))
+	assert.False(t, filter.Keep("01 abcd", "", false))
+}
+
+func TestFilter_OrAndPrecedence(t *testing.T) {
+	// a OR (b AND c)
+	filter, err := sorting.ParseFilter("(0,1,EQ,C'A',OR,0,1,EQ,'B',AND,1,1,EQ,'x')", false)
+	require.NoError(t, err)
+
+	assert.True(t, filter.Keep("Ay", "", false))
+	assert.True(t, filter.Keep("Bx", "", false))
+	assert.False(t, filter.Keep("By", "", false))
+}
+
+func TestFilter_Groups(t *testing.T) {
+	filter, err := sorting.ParseFilter("((0,1,EQ,'A',OR,0,1,EQ,'B'),AND,1,1,EQ,'x')", false)
+	require.NoError(t, err)
+
+	assert.True(t, filter.Keep("Ax", "", false))
+	assert.False(t, filter.Keep("Ay", "", false))
+}
+
+func TestFilter_DelimitedOmit(t *testing.T) {
+	filter, err := sorting.ParseFilter("(1,0,LE,-5)", true)
+	require.NoError(t, err)
+
+	assert.False(t, filter.Keep("a;-10;x", ";", false))
+	assert.True(t, filter.Keep("a;3;x", ";", false))
+}
+
+func TestFilter_QuotedComma(t *testing.T) {
+	filter, err := sorting.ParseFilter("(0,3,NE,'a,b')", false)
+	require.NoError(t, err)
+
+	assert.False(t, filter.Keep("a,b", "", false))
+	assert.True(t, filter.Keep("a;b", "", false))
+}
+
+func TestParseFilter_Errors(t *testing.T) {
+	for _, expr := range []string{
+		"(0,2,XX,'01')",
+		"(0,2,EQ,abc)",
+		"(0,2,EQ)",
+		"(0,2,EQ,'01'",
+		"(0,2,EQ,'01",
+		"(a,2,EQ,'01')",
+		"(0,2,EQ,'01',AND)",
+	} {
+		_, err := sorting.ParseFilter(expr, false)
+		assert.Error(t, err, expr)
+	}
+}
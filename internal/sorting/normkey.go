@@ -0,0 +1,81 @@
+package sorting
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Key encodes the sort keys of a record once into a string that compares
+// bytewise in the same order as CompareKeys, so sorting and merging only
+// compare keys instead of extracting fields on every comparison.
+//
+// Text fields are written as the byte weights of their collation, with 0x00
+// escaped as 0x00 0xFF, and end in 0x00 0x00, so a shorter field sorts first
+// and keys can be concatenated. Numeric
+// fields are the 8 bytes of the float64, with the sign bit flipped for
+// positive numbers and all bits flipped for negative ones. A descending key
+// has all bytes of its part inverted.
+func (o Options) Key(line string) string {
+	if len(o.SortKeys) == 0 {
+		return ""
+	}
+	return string(o.appendKey(nil, line))
+}
+
+// appendKey appends the Key of line to b.
+func (o Options) appendKey(b []byte, line string) []byte {
+	for _, key := range o.SortKeys {
+		field := ExtractField(line, key, o.Delimiter, o.TruncateSpaces)
+		start := len(b)
+		if key.Numeric {
+			b = appendNumericKey(b, field, o.EmptyNumbers)
+		} else {
+			b = appendTextKey(b, field, key.collationTable())
+		}
+		if !key.Asc {
+			for i := start; i < len(b); i++ {
+				b[i] = ^b[i]
+			}
+		}
+	}
+	return b
+}
+
+// appendTextKey appends field, its bytes mapped through table unless nil.
+func appendTextKey(b []byte, field string, table *[256]byte) []byte {
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if table != nil {
+			c = table[c]
+		}
+		b = append(b, c)
+		if c == 0x00 {
+			b = append(b, 0xFF)
+		}
+	}
+	return append(b, 0x00, 0x00)
+}
+
+func appendNumericKey(b []byte, field string, emptyNumbers string) []byte {
+	if field == "" {
+		if strings.ToUpper(emptyNumbers) == "ERROR" {
+			panic(fmt.Sprintf("Empty numeric field encountered: '%s'", field))
+		}
+		field = "0"
+	}
+	// Like CompareKeys, a field that is not a number counts as 0
+	num, _ := strconv.ParseFloat(field, 64)
+	if math.IsNaN(num) || num == 0 {
+		num = 0 // also folds -0 into 0
+	}
+	bits := math.Float64bits(num)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(b, bits)
+}
@@ -0,0 +1,83 @@
+package sorting_test
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+// The encoded keys must order records exactly like CompareKeys.
+func TestKey_MatchesCompareKeys(t *testing.T) {
+	layouts := []sorting.Options{
+		{SortKeys: []sorting.SortKey{{Start: 0, Length: 3, Asc: true}, {Start: 3, Length: 4, Numeric: true, Asc: false}}},
+		{SortKeys: []sorting.SortKey{{Start: 0, Length: 0, Asc: false}}},
+		{SortKeys: []sorting.SortKey{{Start: 1, Numeric: true, Asc: true}, {Start: 0, Asc: false}}, Delimiter: ";"},
+		{SortKeys: []sorting.SortKey{{Start: 0, Length: 4, Asc: true}}, TruncateSpaces: true},
+		{SortKeys: []sorting.SortKey{{Start: 0, Length: 3, Asc: true, Collation: "ebcdic"}, {Start: 3, Asc: false, Collation: "ebcdic"}}},
+	}
+	alphabet := []string{"a", "b", "A", "\x00", "\xff", " ", "-", "1", "9", "0", ".", ";"}
+	rng := rand.New(rand.NewSource(1))
+	randomLine := func() string {
+		var b strings.Builder
+		for range rng.Intn(9) {
+			b.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		return b.String()
+	}
+
+	for _, opts := range layouts {
+		for range 2000 {
+			a, b := randomLine(), randomLine()
+			want := sorting.CompareKeys(a, b, opts.SortKeys, opts.Delimiter, opts.TruncateSpaces, "Z")
+			got := strings.Compare(opts.Key(a), opts.Key(b))
+			if !assert.Equal(t, want, sign(got), "%q vs %q with %v", a, b, opts.SortKeys) {
+				return
+			}
+		}
+	}
+}
+
+func TestKey_Numbers(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Numeric: true, Asc: true}}}
+	ordered := []string{"-1e300", "-12.5", "-1", "", "0", "-0", "abc", "0.001", "2", "10", "1e300"}
+
+	for i := 1; i < len(ordered); i++ {
+		assert.LessOrEqual(t, opts.Key(ordered[i-1]), opts.Key(ordered[i]), "%s before %s", ordered[i-1], ordered[i])
+	}
+	// Empty, zero and text are all 0
+	assert.Equal(t, opts.Key(""), opts.Key("-0"))
+	assert.Equal(t, opts.Key("abc"), opts.Key("0"))
+}
+
+func TestKey_EmptyNumbersError(t *testing.T) {
+	opts := sorting.Options{
+		SortKeys:     []sorting.SortKey{{Start: 0, Numeric: true, Asc: true}},
+		EmptyNumbers: "ERROR",
+	}
+	assert.Panics(t, func() { opts.Key("") })
+}
+
+func TestKey_EbcdicCollation(t *testing.T) {
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true, Collation: "ebcdic"}}}
+	// EBCDIC puts space and punctuation before lower case, then upper case,
+	// then digits
+	ordered := []string{" ", ".", "a", "z", "A", "J", "Z", "0", "9"}
+
+	for i := 1; i < len(ordered); i++ {
+		assert.Less(t, opts.Key(ordered[i-1]), opts.Key(ordered[i]), "%q before %q", ordered[i-1], ordered[i])
+	}
+	assert.Less(t, sorting.CompareKeys("z", "A", opts.SortKeys, "", false, ""), 0)
+}
@@ -0,0 +1,70 @@
+package sorting
+
+import "github.com/joeymeijers/xmsort/internal/utils"
+
+// Options holds the record layout and key settings of a sort job. It is
+// shared by the split phase and every merge of the same job.
+type Options struct {
+	SortKeys         []SortKey
+	Delimiter        string
+	TruncateSpaces   bool
+	RemoveDuplicates bool
+	EmptyNumbers     string
+	RecordLength     int
+	RecordType       string
+	// Stable keeps records with equal keys in input order (EQUALS=Y). Merges
+	// always break ties on run order, which follows the input.
+	Stable bool
+	// DedupByKey treats records with equal sort keys as duplicates; otherwise
+	// only identical records are. KeepLast keeps the last duplicate in input
+	// order instead of the first.
+	DedupByKey bool
+	KeepLast   bool
+	// Discarded receives the removed duplicates when set (XSUM=).
+	Discarded *DiscardLog
+	// SkipRecords drops the first input records (SKIPREC=) and StopAfter
+	// stops reading once that many of the records after them passed Filter
+	// (STOPAFT=), as in DFSORT. Record numbers still count from the start of
+	// the input.
+	SkipRecords int64
+	StopAfter   int64
+	// Filter drops records before they enter a chunk (INCLUDE=/OMIT=).
+	Filter *Filter
+	// Inrec rebuilds records after filtering and before sorting, so the sort
+	// keys refer to its layout. Outrec rebuilds the final output records.
+	Inrec  *Reformat
+	Outrec *Reformat
+	// Sum totals numeric fields of records with equal keys (SUM=).
+	Sum *SumFields
+	// Limit keeps only the first records of the sorted output (LIMIT=).
+	Limit int64
+	// SeqNum numbers the final output records (SEQ=).
+	SeqNum *SeqNum
+	// Memory is the budget for chunks and merge buffers (MEM=); chunks are
+	// written once they hold a share of it. Nil leaves memory unbounded.
+	Memory *utils.MemoryBudget
+}
+
+// Compare orders two records on the sort keys alone. Records with equal keys
+// keep their input order, also when whole records are deduplicated.
+func (o Options) Compare(a, b string) int {
+	return CompareKeys(a, b, o.SortKeys, o.Delimiter, o.TruncateSpaces, o.EmptyNumbers)
+}
+
+// Keep reports whether a record passes the job's INCLUDE= or OMIT= filter.
+func (o Options) Keep(line string) bool {
+	return o.Filter == nil || o.Filter.Keep(line, o.Delimiter, o.TruncateSpaces)
+}
+
+// Reformat applies INREC= to a record read from the input.
+func (o Options) Reformat(line string) string {
+	if o.Inrec == nil {
+		return line
+	}
+	return o.Inrec.Apply(line, o.Delimiter)
+}
+
+// Less reports whether record a sorts before record b.
+func (o Options) Less(a, b string) bool {
+	return o.Compare(a, b) < 0
+}
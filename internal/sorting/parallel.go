@@ -0,0 +1,123 @@
+package sorting
+
+import (
+	"sort"
+	"sync"
+)
+
+// parallelSortThreshold is the chunk size below which one goroutine sorts.
+const parallelSortThreshold = 1 << 16
+
+// parallelSort sorts records with a parallel merge sort: workers sort
+// contiguous parts, then neighbouring runs are merged in rounds. Every
+// merge is cut into pieces along its merge path, so all workers take part
+// in the last rounds too. Ties are taken from the left run, so with stable
+// sorted parts the result is stable. It needs a buffer as large as records.
+func parallelSort[T any](records []T, less func(a, b *T) bool, stable bool, workers int) {
+	n := len(records)
+	parts := min(workers, max(n/(parallelSortThreshold/4), 1))
+	if parts < 2 {
+		sortPart(records, less, stable)
+		return
+	}
+
+	// Sort the parts
+	bounds := make([]int, parts+1)
+	for i := range bounds {
+		bounds[i] = i * n / parts
+	}
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(part []T) {
+			defer wg.Done()
+			sortPart(part, less, stable)
+		}(records[bounds[i]:bounds[i+1]])
+	}
+	wg.Wait()
+
+	// Merge neighbouring runs until one is left
+	src, dst := records, make([]T, n)
+	for len(bounds) > 2 {
+		runs := len(bounds) - 1
+		pieces := max(workers/(runs/2), 1)
+		next := []int{0}
+		for i := 0; i < runs; i += 2 {
+			lo, mid := bounds[i], bounds[i+1]
+			if i+1 == runs {
+				// Odd run out: carried over as it is
+				copy(dst[lo:mid], src[lo:mid])
+				next = append(next, mid)
+				continue
+			}
+			hi := bounds[i+2]
+			mergeParallel(src[lo:mid], src[mid:hi], dst[lo:hi], less, pieces, &wg)
+			next = append(next, hi)
+		}
+		wg.Wait()
+		bounds = next
+		src, dst = dst, src
+	}
+	if &src[0] != &records[0] {
+		copy(records, src)
+	}
+}
+
+func sortPart[T any](part []T, less func(a, b *T) bool, stable bool) {
+	cmp := func(i, j int) bool { return less(&part[i], &part[j]) }
+	if stable {
+		sort.SliceStable(part, cmp)
+	} else {
+		sort.Slice(part, cmp)
+	}
+}
+
+// mergeParallel merges a and b into out in pieces goroutines, added to wg.
+func mergeParallel[T any](a, b, out []T, less func(a, b *T) bool, pieces int, wg *sync.WaitGroup) {
+	n := len(out)
+	pieces = min(pieces, max(n/parallelSortThreshold, 1))
+	prevA, prevB := 0, 0
+	for p := 1; p <= pieces; p++ {
+		d := p * n / pieces
+		splitA := mergePathSplit(a, b, d, less)
+		splitB := d - splitA
+		wg.Add(1)
+		go func(a, b, out []T) {
+			defer wg.Done()
+			mergeRuns(a, b, out, less)
+		}(a[prevA:splitA], b[prevB:splitB], out[prevA+prevB:d])
+		prevA, prevB = splitA, splitB
+	}
+}
+
+// mergePathSplit returns how many records of a are among the first d
+// records of the merge of a and b.
+func mergePathSplit[T any](a, b []T, d int, less func(a, b *T) bool) int {
+	lo, hi := max(0, d-len(b)), min(d, len(a))
+	for lo < hi {
+		mid := (lo + hi) / 2
+		// a[mid] comes out before b[d-mid-1] unless b[d-mid-1] is smaller
+		if !less(&b[d-mid-1], &a[mid]) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func mergeRuns[T any](a, b, out []T, less func(a, b *T) bool) {
+	i, j, k := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if less(&b[j], &a[i]) {
+			out[k] = b[j]
+			j++
+		} else {
+			out[k] = a[i]
+			i++
+		}
+		k++
+	}
+	k += copy(out[k:], a[i:])
+	copy(out[k:], b[j:])
+}
@@ -0,0 +1,57 @@
+package sorting
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelSort_MatchesStableSort(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	records := make([]Record, 150000)
+	for i := range records {
+		// Few distinct keys, so stability shows
+		records[i] = Record{Line: fmt.Sprintf("%03d", rng.Intn(500)), Seq: int64(i + 1)}
+	}
+	less := func(a, b *Record) bool { return a.Line < b.Line }
+	want := append([]Record(nil), records...)
+	sort.SliceStable(want, func(i, j int) bool { return less(&want[i], &want[j]) })
+
+	for _, workers := range []int{2, 3, 8, 13} {
+		got := append([]Record(nil), records...)
+		parallelSort(got, less, true, workers)
+		assert.Equal(t, want, got, "%d workers", workers)
+	}
+}
+
+func TestParallelSort_Unstable(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	records := make([]Record, 100000)
+	for i := range records {
+		records[i] = Record{Line: fmt.Sprintf("%08d", rng.Intn(1000000))}
+	}
+	less := func(a, b *Record) bool { return a.Line < b.Line }
+
+	parallelSort(records, less, false, 4)
+	assert.True(t, sort.SliceIsSorted(records, func(i, j int) bool { return less(&records[i], &records[j]) }))
+}
+
+func TestMergePathSplit(t *testing.T) {
+	rec := func(keys ...string) []Record {
+		out := make([]Record, len(keys))
+		for i, k := range keys {
+			out[i] = Record{Line: k}
+		}
+		return out
+	}
+	less := func(a, b *Record) bool { return a.Line < b.Line }
+	a, b := rec("a", "b", "b", "d"), rec("b", "c")
+
+	// Merged: a b b (from a) b (from b) c d
+	for d, want := range []int{0, 1, 2, 3, 3, 3, 4} {
+		assert.Equal(t, want, mergePathSplit(a, b, d, less), "diagonal %d", d)
+	}
+}
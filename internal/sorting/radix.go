@@ -0,0 +1,97 @@
+package sorting
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+const (
+	// radixMinRecords is the chunk size below which comparison sorting wins.
+	radixMinRecords = 1024
+	// radixCutoff is the bucket size below which a bucket is finished with a
+	// comparison sort.
+	radixCutoff = 64
+)
+
+// fixedKeyLength returns the key length shared by all records, or 0 when
+// the keys differ in length.
+func fixedKeyLength[T any](records []T, key func(*T) []byte) int {
+	if len(records) == 0 {
+		return 0
+	}
+	n := len(key(&records[0]))
+	for i := range records {
+		if len(key(&records[i])) != n {
+			return 0
+		}
+	}
+	return n
+}
+
+// radixSort sorts records on their keys, which all have length keyLen, with
+// a most-significant-byte-first radix sort. Each pass distributes a bucket
+// stably on one key byte, so the sort is stable. The buckets of the first
+// byte are sorted on up to workers goroutines.
+func radixSort[T any](records []T, key func(*T) []byte, keyLen int, workers int) {
+	buf := make([]T, len(records))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	radixPass(records, buf, key, 0, keyLen, func(bucket, bucketBuf []T) {
+		if len(bucket) < parallelSortThreshold || workers < 2 {
+			radixPass(bucket, bucketBuf, key, 1, keyLen, nil)
+			return
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			radixPass(bucket, bucketBuf, key, 1, keyLen, nil)
+		}()
+	})
+	wg.Wait()
+}
+
+// radixPass sorts records, equal in their first depth key bytes, on the
+// remaining bytes. With next set, the buckets are handed to next instead of
+// being sorted here.
+func radixPass[T any](records, buf []T, key func(*T) []byte, depth, keyLen int, next func(bucket, bucketBuf []T)) {
+	if depth >= keyLen || len(records) < 2 {
+		return
+	}
+	if len(records) < radixCutoff {
+		sort.SliceStable(records, func(i, j int) bool {
+			return bytes.Compare(key(&records[i])[depth:], key(&records[j])[depth:]) < 0
+		})
+		return
+	}
+
+	var counts [256]int
+	for i := range records {
+		counts[key(&records[i])[depth]]++
+	}
+	var offsets [257]int
+	for b := range 256 {
+		offsets[b+1] = offsets[b] + counts[b]
+	}
+	pos := offsets
+	for i := range records {
+		b := key(&records[i])[depth]
+		buf[pos[b]] = records[i]
+		pos[b]++
+	}
+	copy(records, buf)
+
+	for b := range 256 {
+		lo, hi := offsets[b], offsets[b+1]
+		if hi-lo < 2 {
+			continue
+		}
+		if next != nil {
+			next(records[lo:hi], buf[lo:hi])
+		} else {
+			radixPass(records[lo:hi], buf[lo:hi], key, depth+1, keyLen, nil)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package sorting
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixedRecords(n int, seed int64) *chunkBuffer {
+	rng := rand.New(rand.NewSource(seed))
+	opts := Options{SortKeys: []SortKey{{Start: 0, Length: 12, Asc: true}}}
+	buf := &chunkBuffer{}
+	for i := range n {
+		// A shared prefix and few distinct values exercise deep buckets
+		buf.add(fmt.Sprintf("KEY%04d%05d", rng.Intn(50), rng.Intn(3)), int64(i+1), opts)
+	}
+	return buf
+}
+
+func TestRadixSort_StableLikeComparisonSort(t *testing.T) {
+	buf := fixedRecords(20000, 1)
+	want := append([]recordRef(nil), buf.refs...)
+	sort.SliceStable(want, func(i, j int) bool {
+		return bytes.Compare(buf.key(&want[i]), buf.key(&want[j])) < 0
+	})
+
+	for _, workers := range []int{1, 4} {
+		got := append([]recordRef(nil), buf.refs...)
+		radixSort(got, buf.key, fixedKeyLength(got, buf.key), workers)
+		assert.Equal(t, want, got, "%d workers", workers)
+	}
+}
+
+func TestFixedKeyLength(t *testing.T) {
+	key := func(s *string) []byte { return []byte(*s) }
+	assert.Equal(t, 2, fixedKeyLength([]string{"ab", "cd"}, key))
+	assert.Equal(t, 0, fixedKeyLength([]string{"ab", "c"}, key))
+	assert.Equal(t, 0, fixedKeyLength(nil, key))
+}
+
+func TestChunkBufferSort_NumericKeysUseRadix(t *testing.T) {
+	// Numbers with leading spaces parse as 0 unless TS=Y
+	opts := Options{SortKeys: []SortKey{{Start: 0, Length: 6, Numeric: true, Asc: false}}, TruncateSpaces: true}
+	rng := rand.New(rand.NewSource(3))
+	buf := &chunkBuffer{}
+	for i := range 5000 {
+		buf.add(fmt.Sprintf("%6d", rng.Intn(200000)-100000), int64(i+1), opts)
+	}
+
+	buf.sort(opts)
+	assert.True(t, sort.SliceIsSorted(buf.refs, func(i, j int) bool {
+		a, b := buf.lineString(&buf.refs[i]), buf.lineString(&buf.refs[j])
+		return CompareKeys(a, b, opts.SortKeys, "", true, "") < 0
+	}))
+}
+
+// BenchmarkSortFixedKeys compares the radix path with the comparison sort of
+// SortLines before normalized keys, on short fixed-length keys.
+func BenchmarkSortFixedKeys(b *testing.B) {
+	const n = 200000
+	keys := []SortKey{{Start: 0, Length: 16, Asc: true}}
+	rng := rand.New(rand.NewSource(1))
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%016x payload", rng.Uint64())
+	}
+
+	b.Run("radix", func(b *testing.B) {
+		for range b.N {
+			work := append([]string(nil), lines...)
+			SortLines(work, keys, "", false, "")
+		}
+	})
+	b.Run("sort.Slice", func(b *testing.B) {
+		for range b.N {
+			work := append([]string(nil), lines...)
+			sort.Slice(work, func(i, j int) bool {
+				return CompareLines(work[i], work[j], keys, "", false, "")
+			})
+		}
+	})
+}
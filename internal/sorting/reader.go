@@ -0,0 +1,112 @@
+package sorting
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+)
+
+// RecordReader reads the records of one or more inputs in turn, as if they
+// were a single concatenated file.
+type RecordReader struct {
+	inputs       []string
+	recordLength int
+	fixed        bool
+
+	source int // index of the input currently being read
+	file   io.ReadCloser
+	reader *bufio.Reader
+	buf    []byte // fixed record, or a variable one longer than the reader's buffer
+}
+
+func NewRecordReader(inputs []string, recordType string, recordLength int) *RecordReader {
+	fixed := strings.ToUpper(recordType) == "F" && recordLength > 0
+	r := &RecordReader{
+		inputs:       inputs,
+		recordLength: recordLength,
+		fixed:        fixed,
+		source:       -1,
+	}
+	if fixed {
+		r.buf = make([]byte, recordLength)
+	}
+	return r
+}
+
+// NewRecordReaderFrom reads the records of a single input that is already
+// open, from the current position of r. The caller closes the input.
+func NewRecordReaderFrom(r *bufio.Reader, recordType string, recordLength int) *RecordReader {
+	rr := NewRecordReader(nil, recordType, recordLength)
+	rr.source, rr.reader = 0, r
+	return rr
+}
+
+// Next returns the next record and the index of the input it was read from.
+// It returns io.EOF once every input is exhausted.
+func (r *RecordReader) Next() (string, int, error) {
+	line, source, err := r.NextBytes()
+	return string(line), source, err
+}
+
+// NextBytes is like Next, but returns a view of the record that is only
+// valid until the next call.
+func (r *RecordReader) NextBytes() ([]byte, int, error) {
+	for {
+		if r.reader == nil {
+			if r.source+1 >= len(r.inputs) {
+				return nil, r.source, io.EOF
+			}
+			r.source++
+			file, err := utils.OpenInput(r.inputs[r.source])
+			if err != nil {
+				return nil, r.source, err
+			}
+			r.file = file
+			r.reader = bufio.NewReader(file)
+		}
+
+		line, err := r.readRecord()
+		if err == io.EOF {
+			r.Close()
+			r.reader = nil
+			if len(line) == 0 {
+				continue
+			}
+			err = nil
+		}
+		return bytes.TrimRight(line, "\r\n"), r.source, err
+	}
+}
+
+func (r *RecordReader) readRecord() ([]byte, error) {
+	if !r.fixed {
+		line, err := r.reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+		// Longer than the reader's buffer: collect the pieces
+		r.buf = append(r.buf[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = r.reader.ReadSlice('\n')
+			r.buf = append(r.buf, line...)
+		}
+		return r.buf, err
+	}
+	// ReadFull because a pipe may return short reads
+	n, err := io.ReadFull(r.reader, r.buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return r.buf[:n], err
+}
+
+// Close closes the input that is currently open, if any.
+func (r *RecordReader) Close() {
+	if r.file != nil {
+		utils.SafeClose(r.file)
+		r.file, r.reader = nil, nil
+	}
+}
@@ -0,0 +1,70 @@
+package sorting_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeInput(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func readAll(t *testing.T, r *sorting.RecordReader) ([]string, []int) {
+	t.Helper()
+	var lines []string
+	var sources []int
+	for {
+		line, source, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		lines = append(lines, line)
+		sources = append(sources, source)
+	}
+	return lines, sources
+}
+
+func TestRecordReader_MultipleInputs(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "a1\na2\n")
+	empty := writeInput(t, dir, "empty.txt", "")
+	b := writeInput(t, dir, "b.txt", "b1\r\nb2")
+
+	r := sorting.NewRecordReader([]string{a, empty, b}, "V", 0)
+	defer r.Close()
+	lines, sources := readAll(t, r)
+	assert.Equal(t, []string{"a1", "a2", "b1", "b2"}, lines)
+	assert.Equal(t, []int{0, 0, 2, 2}, sources)
+}
+
+func TestRecordReader_FixedLength(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.dat", "aaabbbcc")
+
+	r := sorting.NewRecordReader([]string{a}, "F", 3)
+	defer r.Close()
+	lines, _ := readAll(t, r)
+	assert.Equal(t, []string{"aaa", "bbb", "cc"}, lines)
+}
+
+func TestRecordReader_LongLines(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 10000)
+	a := writeInput(t, dir, "a.txt", "short\n"+long+"\nend")
+
+	r := sorting.NewRecordReader([]string{a}, "V", 0)
+	defer r.Close()
+	lines, _ := readAll(t, r)
+	assert.Equal(t, []string{"short", long, "end"}, lines)
+}
@@ -0,0 +1,202 @@
+package sorting
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reformat rebuilds a record from fields and constants (INREC=/OUTREC=):
+//
+//	INREC=(10,5,ZD=8,2X,'ABC',0,10,LENGTH=40)
+//
+// A field is start,length as in sort keys; with a delimiter it selects a
+// column and the items are joined by the delimiter. A field may be followed
+// by ZD=n, which writes its whole number as n display digits (zero-padded,
+// with a leading minus; not packed or zoned decimal bytes), or by
+// TXT, which writes its number as plain text without padding. 'text' (or
+// C'text') inserts a constant, nX inserts n spaces and LENGTH=n pads the
+// record with spaces or truncates it to n characters. For a joined record
+// (REFORMAT=) a field names its file, as in F2:0,5; fields without one come
+// from F1.
+type Reformat struct {
+	items  []reformatItem
+	length int
+}
+
+type reformatItem struct {
+	literal string
+	field   *SortKey
+	source  int  // record the field comes from; 1 is F2 of a join
+	zd      int  // pad the field's number to this width
+	txt     bool // write the field's number as plain text
+}
+
+var spacesItem = regexp.MustCompile(`^(\d+)[Xx]$`)
+
+// ParseReformat compiles a reformat expression.
+func ParseReformat(expr string) (*Reformat, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	// Parentheses only enclose the list
+	var words []string
+	for _, tok := range tokens {
+		if tok != "(" && tok != ")" {
+			words = append(words, tok)
+		}
+	}
+
+	r := &Reformat{}
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		upper := strings.ToUpper(word)
+		switch {
+		case strings.Contains(word, "'"):
+			quote := strings.IndexByte(word, '\'')
+			r.items = append(r.items, reformatItem{literal: word[quote+1 : len(word)-1]})
+		case spacesItem.MatchString(word):
+			n, _ := strconv.Atoi(spacesItem.FindStringSubmatch(word)[1])
+			r.items = append(r.items, reformatItem{literal: strings.Repeat(" ", n)})
+		case strings.HasPrefix(upper, "LENGTH="):
+			n, err := strconv.Atoi(word[len("LENGTH="):])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s in reformat", word)
+			}
+			r.length = n
+		default:
+			source := 0
+			if prefix := strings.IndexByte(upper, ':'); prefix >= 0 {
+				switch upper[:prefix] {
+				case "F1":
+				case "F2":
+					source = 1
+				default:
+					return nil, fmt.Errorf("unknown file %q in reformat", word[:prefix])
+				}
+				word = word[prefix+1:]
+			}
+			start, err := strconv.Atoi(word)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid item %q in reformat", word)
+			}
+			if i+1 >= len(words) {
+				return nil, fmt.Errorf("field at %d has no length", start)
+			}
+			i++
+			length, err := strconv.Atoi(words[i])
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid field length %q in reformat", words[i])
+			}
+			item := reformatItem{field: &SortKey{Start: start, Length: length}, source: source}
+			if i+1 < len(words) {
+				next := strings.ToUpper(words[i+1])
+				switch {
+				case strings.HasPrefix(next, "ZD="):
+					item.zd, err = strconv.Atoi(next[len("ZD="):])
+					if err != nil || item.zd <= 0 {
+						return nil, fmt.Errorf("invalid %s in reformat", words[i+1])
+					}
+					i++
+				case next == "TXT":
+					item.txt = true
+					i++
+				}
+			}
+			r.items = append(r.items, item)
+		}
+	}
+	if len(r.items) == 0 {
+		return nil, fmt.Errorf("reformat has no fields or constants")
+	}
+	return r, nil
+}
+
+// Apply returns the reformatted record.
+func (r *Reformat) Apply(line string, delimiter string) string {
+	return r.apply([]string{line}, delimiter)
+}
+
+// ApplyJoined builds a joined record from an F1 and an F2 record. The
+// missing side of an unpaired record is passed as an empty string, so its
+// fields come out as spaces.
+func (r *Reformat) ApplyJoined(f1, f2 string, delimiter string) string {
+	return r.apply([]string{f1, f2}, delimiter)
+}
+
+func (r *Reformat) apply(records []string, delimiter string) string {
+	parts := make([]string, len(r.items))
+	for i, item := range r.items {
+		if item.field == nil {
+			parts[i] = item.literal
+			continue
+		}
+		line := ""
+		if item.source < len(records) {
+			line = records[item.source]
+		}
+		value := ExtractField(line, *item.field, delimiter, false)
+		switch {
+		case item.zd > 0:
+			value = zonedNumber(value, item.zd)
+		case item.txt:
+			value = plainNumber(value)
+		case delimiter == "" && len(value) < item.field.Length:
+			// Keep fixed positions when the record is short
+			value += strings.Repeat(" ", item.field.Length-len(value))
+		}
+		parts[i] = value
+	}
+
+	sep := ""
+	if delimiter != "" {
+		sep = delimiter
+	}
+	out := strings.Join(parts, sep)
+	if r.length > 0 {
+		if len(out) > r.length {
+			out = out[:r.length]
+		} else {
+			out += strings.Repeat(" ", r.length-len(out))
+		}
+	}
+	return out
+}
+
+// zonedNumber writes the whole part of a numeric field zero-padded to width,
+// sign first; the fraction is dropped. A field that is not a number counts
+// as zero. A number too wide for width loses its high-order digits, as in
+// DFSORT, and a width of 1 has no room for a minus sign.
+func zonedNumber(value string, width int) string {
+	num, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(num) {
+		num = 0
+	}
+	sign := ""
+	if num = math.Trunc(num); num < 0 {
+		sign = "-"
+	}
+	if width == 1 {
+		sign = ""
+	}
+	digits := strconv.FormatFloat(math.Abs(num), 'f', 0, 64)
+	size := width - len(sign)
+	if len(digits) > size {
+		return sign + digits[len(digits)-size:]
+	}
+	return sign + strings.Repeat("0", size-len(digits)) + digits
+}
+
+// plainNumber writes a numeric field without padding or leading zeros. A
+// field that is not a number is only trimmed.
+func plainNumber(value string) string {
+	value = strings.TrimSpace(value)
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
@@ -0,0 +1,76 @@
+package sorting_test
+
+import (
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReformat_FieldsAndConstants(t *testing.T) {
+	r, err := sorting.ParseReformat("(6,4,2X,C'id=',0,5)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "2026  id=abcde", r.Apply("abcde 2026", ""))
+	// Short records keep the field positions
+	assert.Equal(t, "      id=ab   ", r.Apply("ab", ""))
+}
+
+func TestReformat_Length(t *testing.T) {
+	r, err := sorting.ParseReformat("(0,4,LENGTH=6)")
+	require.NoError(t, err)
+	assert.Equal(t, "abcd  ", r.Apply("abcdef", ""))
+
+	r, err = sorting.ParseReformat("(0,8,LENGTH=3)")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", r.Apply("abcdef", ""))
+}
+
+func TestReformat_NumericConversion(t *testing.T) {
+	r, err := sorting.ParseReformat("(0,6,ZD=8,'|',6,8,TXT)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "00000042|12.5", r.Apply("    4200012.500", ""))
+	assert.Equal(t, "-0000007|abc", r.Apply("    -7  abc   ", ""))
+}
+
+func TestReformat_ZonedNumberLimits(t *testing.T) {
+	r, err := sorting.ParseReformat("(0,7,ZD=4)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "-345", r.Apply(" -12345", ""), "too wide loses its high-order digits")
+	assert.Equal(t, "2345", r.Apply("  12345", ""))
+	assert.Equal(t, "-012", r.Apply("  -12.5", ""), "the fraction is dropped")
+	assert.Equal(t, "0000", r.Apply("   -0.5", ""))
+
+	r, err = sorting.ParseReformat("(0,3,ZD=1)")
+	require.NoError(t, err)
+	assert.Equal(t, "7", r.Apply("-17", ""), "no room for the sign")
+}
+
+func TestReformat_DelimitedColumns(t *testing.T) {
+	r, err := sorting.ParseReformat("(2,0,'X',0,0)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "c;X;a", r.Apply("a;b;c", ";"))
+}
+
+func TestParseReformat_Errors(t *testing.T) {
+	for _, expr := range []string{"()", "(5)", "(0,a)", "(0,5,ZD=0)", "(LENGTH=x)", "(FOO)"} {
+		_, err := sorting.ParseReformat(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestReformat_JoinedRecord(t *testing.T) {
+	r, err := sorting.ParseReformat("(0,2,'|',F2:1,2,'|',F1:2,1)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "ab|yz|c", r.ApplyJoined("abc", "xyz", ""))
+	// The missing side of an unpaired record comes out as spaces
+	assert.Equal(t, "ab|  |c", r.ApplyJoined("abc", "", ""))
+
+	_, err = sorting.ParseReformat("(F3:0,2)")
+	assert.Error(t, err)
+}
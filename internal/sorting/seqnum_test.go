@@ -0,0 +1,54 @@
+package sorting_test
+
+import (
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequencer_InsertAndAppend(t *testing.T) {
+	seq, err := sorting.ParseSeqNum("(2,3)")
+	require.NoError(t, err)
+	s := sorting.NewSequencer(seq, "")
+	assert.Equal(t, "ab001cd", s.Number("abcd", "abcd"))
+	assert.Equal(t, "x 002", s.Number("x", "x"))
+
+	seq, err = sorting.ParseSeqNum("(END,2)")
+	require.NoError(t, err)
+	s = sorting.NewSequencer(seq, "")
+	assert.Equal(t, "abc01", s.Number("abc", "abc"))
+}
+
+func TestSequencer_Wraps(t *testing.T) {
+	seq, err := sorting.ParseSeqNum("(END,1)")
+	require.NoError(t, err)
+	s := sorting.NewSequencer(seq, "")
+	for range 9 {
+		s.Number("", "")
+	}
+	assert.Equal(t, "0", s.Number("", ""))
+}
+
+func TestSequencer_RestartKeyAndColumns(t *testing.T) {
+	seq, err := sorting.ParseSeqNum("(1,4)")
+	require.NoError(t, err)
+	seq.RestartKey, err = sorting.ParseSeqKey("(0,0)")
+	require.NoError(t, err)
+	s := sorting.NewSequencer(seq, ";")
+
+	assert.Equal(t, "a;0001;x", s.Number("a;x", "a;x"))
+	assert.Equal(t, "a;0002;y", s.Number("a;y", "a;y"))
+	assert.Equal(t, "b;0001;z", s.Number("b;z", "b;z"))
+	// Past the last column the number is appended
+	seq.Position = 5
+	assert.Equal(t, "b;z;0002", s.Number("b;z", "b;z"))
+}
+
+func TestParseSeqNum_Errors(t *testing.T) {
+	for _, expr := range []string{"(5)", "(x,2)", "(0,0)", "(END,x)"} {
+		_, err := sorting.ParseSeqNum(expr)
+		assert.Error(t, err, expr)
+	}
+}
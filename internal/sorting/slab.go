@@ -0,0 +1,138 @@
+package sorting
+
+import (
+	"bytes"
+	"runtime"
+	"unsafe"
+)
+
+// slabSize is the size of the byte slabs that hold a chunk's records;
+// chunks under a small memory budget use smaller ones, down to minSlabSize.
+const (
+	slabSize    = 4 << 20
+	minSlabSize = 4 << 10
+)
+
+// recordRef locates one record in a chunkBuffer. It holds no pointers, so
+// the garbage collector never scans the index of a chunk.
+type recordRef struct {
+	slab    int32
+	off     int32 // the line starts here, its key follows it
+	lineLen int32
+	keyLen  int32
+	seq     int64
+}
+
+const recordRefSize = int64(unsafe.Sizeof(recordRef{}))
+
+// chunkBuffer holds the records of a chunk back to back in large byte slabs,
+// each line followed by its encoded key (Options.Key), with an index that is
+// sorted instead of the records. Its memory is the slabs plus 24 bytes of
+// index per record.
+type chunkBuffer struct {
+	slabs     [][]byte
+	refs      []recordRef
+	slabBytes int    // size of new slabs, slabSize when 0
+	allocated int64  // bytes of slabs allocated
+	reserved  int64  // taken from Options.Memory for this chunk
+	scratch   []byte // the key being added, before it is copied to a slab
+}
+
+// newChunkBuffer returns a buffer for chunks of up to chunkBytes, with
+// slabs that are a small part of that; 0 is unlimited.
+func newChunkBuffer(chunkBytes int64) *chunkBuffer {
+	if chunkBytes <= 0 {
+		return &chunkBuffer{}
+	}
+	return &chunkBuffer{slabBytes: int(min(max(chunkBytes/16, minSlabSize), slabSize))}
+}
+
+// add copies a record into the buffer and encodes its key next to it. The
+// line is not retained, so it may be a view of a reused buffer.
+func (c *chunkBuffer) add(line string, seq int64, opts Options) {
+	// Keys may overlap or repeat fields, so the key is encoded first to
+	// know the exact size the record takes
+	c.scratch = opts.appendKey(c.scratch[:0], line)
+	c.addKeyed(line, bytesView(c.scratch), seq)
+}
+
+// addKeyed copies a record and its encoded key into the buffer.
+func (c *chunkBuffer) addKeyed(line, key string, seq int64) {
+	need := len(line) + len(key)
+	if len(c.slabs) == 0 || cap(c.slabs[len(c.slabs)-1])-len(c.slabs[len(c.slabs)-1]) < need {
+		size := c.slabBytes
+		if size == 0 {
+			size = slabSize
+		}
+		c.slabs = append(c.slabs, make([]byte, 0, max(size, need)))
+		c.allocated += int64(max(size, need))
+	}
+	i := len(c.slabs) - 1
+	slab := c.slabs[i]
+	off := len(slab)
+	slab = append(slab, line...)
+	slab = append(slab, key...)
+	c.slabs[i] = slab
+
+	c.refs = append(c.refs, recordRef{
+		slab:    int32(i),
+		off:     int32(off),
+		lineLen: int32(len(line)),
+		keyLen:  int32(len(key)),
+		seq:     seq,
+	})
+}
+
+// memory returns the bytes the chunk holds once sorted: its slabs, the
+// index and the index copy that sorting needs.
+func (c *chunkBuffer) memory() int64 {
+	return c.allocated + int64(cap(c.refs)+len(c.refs))*recordRefSize
+}
+
+func (c *chunkBuffer) line(r *recordRef) []byte {
+	return c.slabs[r.slab][r.off : r.off+r.lineLen]
+}
+
+func (c *chunkBuffer) key(r *recordRef) []byte {
+	start := r.off + r.lineLen
+	return c.slabs[r.slab][start : start+r.keyLen]
+}
+
+// lineString returns the line without copying it; slabs are never changed
+// once written.
+func (c *chunkBuffer) lineString(r *recordRef) string {
+	return bytesView(c.line(r))
+}
+
+// sort orders the index on the record keys, on all cores when the chunk is
+// large. Chunks are filled in input order, so a stable sort keeps equal
+// keys in input order; that is needed for EQUALS=Y, to keep the first or
+// last duplicate and to sum into the first record.
+func (c *chunkBuffer) sort(opts Options) {
+	less := func(a, b *recordRef) bool {
+		return bytes.Compare(c.key(a), c.key(b)) < 0
+	}
+	stable := opts.Stable || opts.RemoveDuplicates || opts.Sum != nil
+	if len(c.refs) >= radixMinRecords {
+		// Fixed-length keys, such as fixed fields or numbers, sort faster
+		// byte by byte; the radix sort is stable as well
+		if keyLen := fixedKeyLength(c.refs, c.key); keyLen > 0 {
+			radixSort(c.refs, c.key, keyLen, runtime.NumCPU())
+			return
+		}
+	}
+	if len(c.refs) >= parallelSortThreshold && runtime.NumCPU() > 1 {
+		parallelSort(c.refs, less, stable, runtime.NumCPU())
+		return
+	}
+	sortPart(c.refs, less, stable)
+}
+
+// bytesView returns b as a string without copying. b must not change while
+// the string is in use.
+func bytesView(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
@@ -0,0 +1,75 @@
+package sorting
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkBuffer_AddKeepsLinesAndKeys(t *testing.T) {
+	opts := Options{SortKeys: []SortKey{{Start: 0, Length: 3, Asc: true}}}
+	buf := &chunkBuffer{}
+	long := strings.Repeat("z", slabSize+1)
+	for i, line := range []string{"bbb1", "", long, "aaa2"} {
+		buf.add(line, int64(i+1), opts)
+	}
+
+	require.Len(t, buf.refs, 4)
+	assert.Equal(t, 3, len(buf.slabs), "a record larger than a slab gets a slab of its own size")
+	for i, line := range []string{"bbb1", "", long, "aaa2"} {
+		assert.Equal(t, line, string(buf.line(&buf.refs[i])))
+		assert.Equal(t, opts.Key(line), string(buf.key(&buf.refs[i])))
+		assert.Equal(t, int64(i+1), buf.refs[i].seq)
+	}
+}
+
+func TestChunkBuffer_OverlappingKeysStayInSlab(t *testing.T) {
+	// Every key encodes the whole line, each 0x00 as two bytes
+	key := SortKey{Start: 0, Length: 1000, Asc: true}
+	opts := Options{SortKeys: []SortKey{key, key, key, key, key, key, key, key}}
+	buf := newChunkBuffer(16 * minSlabSize)
+	line := strings.Repeat("\x00", 1000)
+	for i := range 4 {
+		buf.add(line, int64(i+1), opts)
+	}
+
+	var capacity int64
+	for _, slab := range buf.slabs {
+		capacity += int64(cap(slab))
+	}
+	assert.Equal(t, buf.allocated, capacity, "slabs never grow past what is counted")
+	assert.Equal(t, opts.Key(line), string(buf.key(&buf.refs[3])))
+}
+
+func TestChunkBuffer_SortStable(t *testing.T) {
+	opts := Options{SortKeys: []SortKey{{Start: 0, Length: 1, Asc: true}}, Stable: true}
+	buf := &chunkBuffer{}
+	for i, line := range []string{"b1", "a2", "b3", "a4"} {
+		buf.add(line, int64(i+1), opts)
+	}
+	buf.sort(opts)
+
+	var got []string
+	for i := range buf.refs {
+		got = append(got, fmt.Sprintf("%s/%d", buf.lineString(&buf.refs[i]), buf.refs[i].seq))
+	}
+	assert.Equal(t, []string{"a2/2", "a4/4", "b1/1", "b3/3"}, got)
+}
+
+func TestPrepareChunk_CompactsLimitedChunk(t *testing.T) {
+	opts := Options{SortKeys: []SortKey{{Start: 0, Length: 2, Asc: true}}, RemoveDuplicates: true, Limit: 2}
+	buf := &chunkBuffer{}
+	for i, line := range []string{"cc", "aa", "bb", "aa"} {
+		buf.add(line, int64(i+1), opts)
+	}
+
+	out, err := prepareChunk(buf, opts)
+	require.NoError(t, err)
+	require.Len(t, out.refs, 2)
+	assert.Equal(t, "aa", out.lineString(&out.refs[0]))
+	assert.Equal(t, "bb", out.lineString(&out.refs[1]))
+	assert.Equal(t, int64(3), out.refs[1].seq)
+}
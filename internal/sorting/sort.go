@@ -5,16 +5,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/cheggaaa/pb/v3"
 	"github.com/joeymeijers/xmsort/internal/utils"
 )
 
+// ebcdicToAscii maps EBCDIC (code page 037) to Latin-1.
 var ebcdicToAscii = [256]byte{
 	0x00, 0x01, 0x02, 0x03, 0x9c, 0x09, 0x86, 0x7f,
 	0x97, 0x8d, 0x8e, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
@@ -25,11 +25,11 @@ var ebcdicToAscii = [256]byte{
 	0x90, 0x91, 0x16, 0x93, 0x94, 0x95, 0x96, 0x04,
 	0x98, 0x99, 0x9a, 0x9b, 0x14, 0x15, 0x9e, 0x1a,
 	0x20, 0xa0, 0xe2, 0xe4, 0xe0, 0xe1, 0xe3, 0xe5,
-	0xe7, 0xf1, 0x5b, 0x2e, 0x3c, 0x28, 0x2b, 0x7c,
+	0xe7, 0xf1, 0xa2, 0x2e, 0x3c, 0x28, 0x2b, 0x7c,
 	0x26, 0xe9, 0xea, 0xeb, 0xe8, 0xed, 0xee, 0xef,
-	0xec, 0xdf, 0x21, 0x24, 0x2a, 0x29, 0x3b, 0x5e,
+	0xec, 0xdf, 0x21, 0x24, 0x2a, 0x29, 0x3b, 0xac,
 	0x2d, 0x2f, 0xc2, 0xc4, 0xc0, 0xc1, 0xc3, 0xc5,
-	0xc7, 0xd1, 0x7b, 0x2c, 0x25, 0x5f, 0x3e, 0x3f,
+	0xc7, 0xd1, 0xa6, 0x2c, 0x25, 0x5f, 0x3e, 0x3f,
 	0xf8, 0xc9, 0xca, 0xcb, 0xc8, 0xcd, 0xce, 0xcf,
 	0xcc, 0x60, 0x3a, 0x23, 0x40, 0x27, 0x3d, 0x22,
 	0xd8, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67,
@@ -37,19 +37,28 @@ var ebcdicToAscii = [256]byte{
 	0xb0, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70,
 	0x71, 0x72, 0xaa, 0xba, 0xe6, 0xb8, 0xc6, 0xa4,
 	0xb5, 0x7e, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
-	0x79, 0x7a, 0xa1, 0xbf, 0xd0, 0x5b, 0xde, 0xae,
-	0xac, 0xa3, 0xa5, 0xb7, 0xa9, 0xa7, 0xb6, 0xbc,
-	0xbd, 0xbe, 0xdd, 0xa8, 0xaf, 0x5d, 0xb4, 0xd7,
-	0x7c, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47,
+	0x79, 0x7a, 0xa1, 0xbf, 0xd0, 0xdd, 0xde, 0xae,
+	0x5e, 0xa3, 0xa5, 0xb7, 0xa9, 0xa7, 0xb6, 0xbc,
+	0xbd, 0xbe, 0x5b, 0x5d, 0xaf, 0xa8, 0xb4, 0xd7,
+	0x7b, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47,
 	0x48, 0x49, 0xad, 0xf4, 0xf6, 0xf2, 0xf3, 0xf5,
-	0x5c, 0xf7, 0x50, 0x51, 0x52, 0x53, 0x54, 0x55,
-	0x56, 0x57, 0x58, 0x59, 0x5a, 0xb2, 0xd4, 0xd6,
-	0xd2, 0xd3, 0xd5, 0x30, 0x31, 0x32, 0x33, 0x34,
-	0x35, 0x36, 0x37, 0x38, 0x39, 0xb3, 0xdb, 0xdc,
-	0xd9, 0xda, 0x9f, 0x9f, 0x9f, 0x9f, 0x9f, 0x9f,
-	0x9f, 0x9f, 0x9f, 0x9f, 0x9f, 0x9f, 0x9f, 0x9f,
+	0x7d, 0x4a, 0x4b, 0x4c, 0x4d, 0x4e, 0x4f, 0x50,
+	0x51, 0x52, 0xb9, 0xfb, 0xfc, 0xf9, 0xfa, 0xff,
+	0x5c, 0xf7, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+	0x59, 0x5a, 0xb2, 0xd4, 0xd6, 0xd2, 0xd3, 0xd5,
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+	0x38, 0x39, 0xb3, 0xdb, 0xdc, 0xd9, 0xda, 0x9f,
 }
 
+// ebcdicCollation gives each byte its EBCDIC code point, so g=ebcdic keys
+// sort in the EBCDIC collating sequence.
+var ebcdicCollation = func() (t [256]byte) {
+	for e, a := range ebcdicToAscii {
+		t[a] = byte(e)
+	}
+	return t
+}()
+
 func EBCDICToASCII(s string) string {
 	b := []byte(s)
 	for i := range b {
@@ -59,50 +68,96 @@ func EBCDICToASCII(s string) string {
 }
 
 func CompareLines(a, b string, keys []SortKey, delimiter string, truncateSpaces bool, emptyNumbers string) bool {
+	return CompareKeys(a, b, keys, delimiter, truncateSpaces, emptyNumbers) < 0
+}
+
+// CompareKeys compares two lines on the sort keys and returns -1 when a sorts
+// before b, 1 when it sorts after b and 0 when all keys are equal.
+func CompareKeys(a, b string, keys []SortKey, delimiter string, truncateSpaces bool, emptyNumbers string) int {
 	for _, key := range keys {
 		fieldA := ExtractField(a, key, delimiter, truncateSpaces)
 		fieldB := ExtractField(b, key, delimiter, truncateSpaces)
+		if c := compareFields(fieldA, fieldB, key, emptyNumbers); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
 
-		if key.Numeric {
-			if fieldA == "" || fieldB == "" {
-				if strings.ToUpper(emptyNumbers) == "ERROR" {
-					panic(fmt.Sprintf("Empty numeric field encountered: '%s' vs '%s'", fieldA, fieldB))
-				} else {
-					if fieldA == "" {
-						fieldA = "0"
-					}
-					if fieldB == "" {
-						fieldB = "0"
-					}
-				}
-			}
-			numA, _ := strconv.ParseFloat(fieldA, 64)
-			numB, _ := strconv.ParseFloat(fieldB, 64)
-			if numA == numB {
-				continue
-			}
-			if key.Asc {
-				return numA < numB
-			}
-			return numA > numB
-		} else {
-			if fieldA == fieldB {
-				continue
+// collationTable returns the byte weights of the key's collation, or nil
+// when text compares bytewise.
+func (k SortKey) collationTable() *[256]byte {
+	if k.EBCDIC() {
+		return &ebcdicCollation
+	}
+	return nil
+}
+
+// compareCollated compares a and b byte by byte on their weights in table.
+func compareCollated(a, b string, table *[256]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if wa, wb := table[a[i]], table[b[i]]; wa != wb {
+			if wa < wb {
+				return -1
 			}
-			if key.Asc {
-				return fieldA < fieldB
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func compareFields(fieldA, fieldB string, key SortKey, emptyNumbers string) int {
+	c := 0
+	if key.Numeric {
+		if fieldA == "" || fieldB == "" {
+			if strings.ToUpper(emptyNumbers) == "ERROR" {
+				panic(fmt.Sprintf("Empty numeric field encountered: '%s' vs '%s'", fieldA, fieldB))
+			} else {
+				if fieldA == "" {
+					fieldA = "0"
+				}
+				if fieldB == "" {
+					fieldB = "0"
+				}
 			}
-			return fieldA > fieldB
 		}
+		numA, _ := strconv.ParseFloat(fieldA, 64)
+		numB, _ := strconv.ParseFloat(fieldB, 64)
+		if numA < numB {
+			c = -1
+		} else if numA > numB {
+			c = 1
+		}
+	} else if table := key.collationTable(); table != nil {
+		c = compareCollated(fieldA, fieldB, table)
+	} else {
+		c = strings.Compare(fieldA, fieldB)
+	}
+	if !key.Asc {
+		c = -c
 	}
-	return false
+	return c
 }
 
 // sortLines sorts a batch of lines based on the provided sort keys.
 func SortLines(lines []string, keys []SortKey, delimiter string, truncateSpaces bool, emptyNumbers string) {
-	sort.Slice(lines, func(i, j int) bool {
-		return CompareLines(lines[i], lines[j], keys, delimiter, truncateSpaces, emptyNumbers)
-	})
+	opts := Options{SortKeys: keys, Delimiter: delimiter, TruncateSpaces: truncateSpaces, EmptyNumbers: emptyNumbers}
+	buf := &chunkBuffer{}
+	for i, line := range lines {
+		buf.add(line, int64(i), opts)
+	}
+	buf.sort(opts)
+	sorted := make([]string, len(lines))
+	for i := range buf.refs {
+		sorted[i] = lines[buf.refs[i].seq]
+	}
+	copy(lines, sorted)
 }
 
 // extractField extracts a field from a line based on the provided sort key and delimiter.
@@ -137,136 +192,329 @@ func ExtractField(line string, key SortKey, delimiter string, truncateSpaces boo
 	return val
 }
 
+// Record is an input record with its 1-based record number in the input.
+// The number travels with the record through chunks and merges.
+type Record struct {
+	Line string
+	Seq  int64
+}
+
 func ProcessChunk(lines []string, chunkIndex int, sortKeys []SortKey, tempDir, delimiter string, truncateSpaces bool, removeDuplicates bool, emptyNumbers string) (string, error) {
-	SortLines(lines, sortKeys, delimiter, truncateSpaces, emptyNumbers)
-	if removeDuplicates {
-		lines = utils.RemoveDuplicates(lines)
+	opts := Options{
+		SortKeys:         sortKeys,
+		Delimiter:        delimiter,
+		TruncateSpaces:   truncateSpaces,
+		RemoveDuplicates: removeDuplicates,
+		EmptyNumbers:     emptyNumbers,
+	}
+	buf := &chunkBuffer{}
+	for i, line := range lines {
+		buf.add(line, int64(i+1), opts)
+	}
+	return processChunk(buf, chunkIndex, tempDir, opts)
+}
+
+func processChunk(buf *chunkBuffer, chunkIndex int, tempDir string, opts Options) (string, error) {
+	defer opts.Memory.Release(buf.reserved)
+	buf, err := prepareChunk(buf, opts)
+	if err != nil {
+		return "", err
+	}
+	return writeRun(buf, chunkIndex, tempDir)
+}
+
+// copiesChunks reports whether prepareChunk may copy a chunk. The copy is
+// made while the chunk is still held, so such chunks are filled to half
+// their share of the budget.
+func copiesChunks(opts Options) bool {
+	return opts.RemoveDuplicates || opts.Sum != nil || opts.Limit > 0
+}
+
+// prepareChunk sorts a chunk and applies duplicate removal, SUM= and LIMIT=
+// to it. When any of them applies, the records that are left are copied
+// into a new buffer, so the memory of the dropped ones is released.
+func prepareChunk(buf *chunkBuffer, opts Options) (*chunkBuffer, error) {
+	buf.sort(opts)
+	if !opts.RemoveDuplicates && opts.Sum == nil && (opts.Limit <= 0 || int64(len(buf.refs)) <= opts.Limit) {
+		return buf, nil
+	}
+
+	out := &chunkBuffer{slabBytes: buf.slabBytes, reserved: buf.reserved}
+	emit := func(line, key string, seq int64) error {
+		if opts.Limit <= 0 || int64(len(out.refs)) < opts.Limit {
+			out.addKeyed(line, key, seq)
+		}
+		return nil
+	}
+	var summer *Summer
+	if opts.Sum != nil {
+		summer = NewSummer(opts, emit)
+		emit = summer.Add
+	}
+	var dedup *Deduplicator
+	if opts.RemoveDuplicates {
+		dedup = NewDeduplicator(opts, emit)
+		emit = dedup.Add
+	}
+	for i := range buf.refs {
+		// The views stay valid: buf is not changed while out is filled
+		ref := &buf.refs[i]
+		if err := emit(buf.lineString(ref), bytesView(buf.key(ref)), ref.seq); err != nil {
+			return nil, err
+		}
+	}
+	if dedup != nil {
+		if err := dedup.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if summer != nil {
+		if err := summer.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// writeRun writes a sorted chunk to a chunk run file.
+func writeRun(buf *chunkBuffer, index int, tempDir string) (string, error) {
+	filename := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.run", index))
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer utils.SafeClose(file)
+
+	writer := bufio.NewWriter(file)
+	run, err := utils.NewRunWriter(writer)
+	if err != nil {
+		return "", err
+	}
+	for i := range buf.refs {
+		if err := run.Write(buf.lineString(&buf.refs[i]), buf.refs[i].seq); err != nil {
+			return "", err
+		}
+	}
+	if err := run.Close(); err != nil {
+		return "", err
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
 	}
-	return utils.WriteChunk(lines, chunkIndex, tempDir)
+	return filename, nil
 }
 
+// SplitFileAndSort streams the inputs in turn, sorts chunks of chunkSize
+// records in parallel and returns the chunk files in input order. With
+// Options.Memory a chunk also ends at its share of the budget, and reading
+// waits while the chunks in flight hold the budget; chunkSize 0 leaves the
+// size to the budget.
 func SplitFileAndSort(
-	inputFile string,
+	inputFiles []string,
 	chunkSize int,
-	sortKeys []SortKey,
 	tempDir string,
-	delimiter string,
-	truncateSpaces bool,
-	removeDuplicates bool,
-	emptyNumbers string,
-	recordLength int,
-	recordType string,
+	opts Options,
 ) ([]string, error) {
-	file, err := os.Open(inputFile)
-	if err != nil {
-		return nil, err
-	}
-	defer utils.SafeClose(file)
+	chunkFiles, _, err := splitInput(inputFiles, chunkSize, tempDir, opts, false)
+	return chunkFiles, err
+}
+
+// SortFile is SplitFileAndSort, except that input that fits in the memory
+// budget less the share of one chunk, and in chunkSize records if set, is
+// sorted in memory and returned without writing a chunk file.
+func SortFile(
+	inputFiles []string,
+	chunkSize int,
+	tempDir string,
+	opts Options,
+) ([]string, *Sorted, error) {
+	return splitInput(inputFiles, chunkSize, tempDir, opts, true)
+}
+
+func splitInput(
+	inputFiles []string,
+	chunkSize int,
+	tempDir string,
+	opts Options,
+	inMemory bool,
+) ([]string, *Sorted, error) {
+	reader := NewRecordReader(inputFiles, opts.RecordType, opts.RecordLength)
+	defer reader.Close()
 
 	var (
 		errOnce    sync.Once
 		exitErr    error
 		chunkFiles []string
-		lines      []string
+		buf        *chunkBuffer
 		wg         sync.WaitGroup
 	)
 
 	chunkIndex := 0
-	chunkChan := make(chan string, 10)
+	chunkChan := make(chan chunkResult, 10)
+	collected := make(chan struct{})
 	maxWorkers := runtime.NumCPU()
 	sem := make(chan struct{}, maxWorkers)
 
 	go func() {
-		for chunkFile := range chunkChan {
-			chunkFiles = append(chunkFiles, chunkFile)
+		defer close(collected)
+		for result := range chunkChan {
+			if result.index >= len(chunkFiles) {
+				chunkFiles = append(chunkFiles, make([]string, result.index-len(chunkFiles)+1)...)
+			}
+			chunkFiles[result.index] = result.file
 		}
 	}()
 
-	totalLinesEstimate := utils.EstimateLineCount(inputFile)
-	bar := pb.StartNew(totalLinesEstimate)
-	bar.SetWriter(os.Stdout)
+	// Stdin cannot be sampled up front, so its bar only counts records.
+	totalLinesEstimate := 0
+	for _, inputFile := range inputFiles {
+		if inputFile != utils.STDIO {
+			totalLinesEstimate += utils.EstimateLineCount(inputFile)
+		}
+	}
+	bar := utils.StartProgressBar(totalLinesEstimate)
 
 	totalLines := 0
+	filtered := 0
+	var kept int64 // records past SKIPREC= and INCLUDE=/OMIT=, for STOPAFT=
+	chunkBytes := opts.Memory.ChunkBytes()
+	// limit is the share of the budget of the chunk being filled. While
+	// nothing is written the input may still fit in memory as a whole, so
+	// the first chunk of SortFile may take all of the budget but the share
+	// of the next chunk, which is filled while the first one is written
+	limit := chunkBytes
+	if inMemory {
+		limit = opts.Memory.Total() - chunkBytes
+	}
+	full := func(buf *chunkBuffer) bool {
+		fill := limit
+		if copiesChunks(opts) {
+			// prepareChunk copies the records into the other half
+			fill /= 2
+		}
+		return (chunkSize > 0 && len(buf.refs) >= chunkSize) || (limit > 0 && buf.memory() >= fill)
+	}
+	buf = newChunkBuffer(limit)
 
-	flushChunk := func(lines []string, chunkIndex int) {
+	flushChunk := func(buf *chunkBuffer, chunkIndex int) {
 		wg.Add(1)
 		sem <- struct{}{}
-		go func(lines []string, chunkIndex int) {
+		go func(buf *chunkBuffer, chunkIndex int) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			chunkFile, err := ProcessChunk(lines, chunkIndex, sortKeys, tempDir, delimiter, truncateSpaces, removeDuplicates, emptyNumbers)
+			chunkFile, err := processChunk(buf, chunkIndex, tempDir, opts)
 			if err != nil {
 				errOnce.Do(func() { exitErr = err })
 				return
 			}
-			chunkChan <- chunkFile
-		}(lines, chunkIndex)
-	}
-
-	if strings.ToUpper(recordType) == "F" && recordLength > 0 {
-		// Fixed-width records
-		buf := make([]byte, recordLength)
-		for {
-			n, err := file.Read(buf)
-			if n > 0 {
-				line := string(buf[:n])
-				lines = append(lines, strings.TrimRight(line, "\r\n"))
-				totalLines++
-				bar.Increment()
-				if len(lines) >= chunkSize {
-					flushChunk(lines, chunkIndex)
-					lines = nil
-					chunkIndex++
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
+			chunkChan <- chunkResult{index: chunkIndex, file: chunkFile}
+		}(buf, chunkIndex)
+	}
+
+	for {
+		if opts.StopAfter > 0 && kept >= opts.StopAfter {
+			utils.LogInfo("Stopped reading after %d records", opts.StopAfter)
+			break
 		}
-	} else {
-		// Variable-length records (default)
-		reader := bufio.NewReader(file)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					if len(line) > 0 || totalLines == 0 {
-						lines = append(lines, strings.TrimRight(line, "\r\n"))
-						totalLines++
-						bar.Increment()
-					}
-					break
-				}
-				return nil, err
-			}
-			line = strings.TrimRight(line, "\r\n")
-			lines = append(lines, line)
-			totalLines++
-			bar.Increment()
-
-			if len(lines) >= chunkSize {
-				flushChunk(lines, chunkIndex)
-				lines = nil
-				chunkIndex++
+		// The view is only valid until the next read; buf.add copies it
+		view, _, err := reader.NextBytes()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			close(chunkChan)
+			bar.Finish()
+			return nil, nil, err
+		}
+		totalLines++
+		bar.Increment()
+		if int64(totalLines) <= opts.SkipRecords {
+			continue
+		}
+		line := bytesView(view)
+		if !opts.Keep(line) {
+			filtered++
+			continue
+		}
+		kept++
+		if len(buf.refs) == 0 && buf.reserved == 0 {
+			buf.reserved = opts.Memory.Acquire(limit)
+		}
+		buf.add(opts.Reformat(line), int64(totalLines), opts)
+
+		if full(buf) && opts.Limit > 0 && opts.Limit < int64(len(buf.refs)) {
+			// Only the best records can reach the output, so cut the
+			// chunk back to them instead of writing it
+			if buf, err = prepareChunk(buf, opts); err != nil {
+				wg.Wait()
+				close(chunkChan)
+				bar.Finish()
+				return nil, nil, err
 			}
 		}
+		if full(buf) {
+			flushChunk(buf, chunkIndex)
+			limit = chunkBytes
+			buf = newChunkBuffer(limit)
+			chunkIndex++
+		}
 	}
 
-	if len(lines) > 0 {
-		flushChunk(lines, chunkIndex)
+	var sorted *Sorted
+	if inMemory && chunkIndex == 0 {
+		// Nothing was written: the whole input is in buf
+		if buf, err := prepareChunk(buf, opts); err != nil {
+			errOnce.Do(func() { exitErr = err })
+		} else {
+			sorted = &Sorted{buf: buf}
+		}
+	} else if len(buf.refs) > 0 {
+		flushChunk(buf, chunkIndex)
 	}
 
 	wg.Wait()
 	close(chunkChan)
+	<-collected
 	bar.Finish()
 
 	if exitErr != nil {
-		return nil, exitErr
+		return nil, nil, exitErr
 	}
 
 	utils.LogInfo("Total lines read: %d", totalLines)
-	return chunkFiles, nil
+	if opts.SkipRecords > 0 {
+		utils.LogInfo("Lines skipped: %d", min(opts.SkipRecords, int64(totalLines)))
+	}
+	if opts.Filter != nil {
+		utils.LogInfo("Lines dropped by filter: %d", filtered)
+	}
+	return chunkFiles, sorted, nil
+}
+
+// Sorted is an input that was sorted in memory, with duplicate removal,
+// SUM= and LIMIT= applied like for a chunk.
+type Sorted struct {
+	buf *chunkBuffer
+}
+
+// Len returns the number of records.
+func (s *Sorted) Len() int { return len(s.buf.refs) }
+
+// Each calls fn with the records and their keys in sorted order until fn
+// fails.
+func (s *Sorted) Each(fn func(line, key string, seq int64) error) error {
+	for i := range s.buf.refs {
+		ref := &s.buf.refs[i]
+		if err := fn(s.buf.lineString(ref), bytesView(s.buf.key(ref)), ref.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkResult is a sorted chunk file and its position in the input.
+type chunkResult struct {
+	index int
+	file  string
 }
@@ -1,14 +1,24 @@
 package sorting_test
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/joeymeijers/xmsort/internal/sorting"
 	"github.com/joeymeijers/xmsort/internal/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func init() {
+	utils.OverrideLogger(log.New(io.Discard, "", 0))
+}
+
 func TestCompareLines_StringAscending(t *testing.T) {
 	keys := []sorting.SortKey{{Start: 0, Length: 0, Numeric: false, Asc: true}}
 	a := "apple"
@@ -131,23 +141,249 @@ func TestExtractField_FixedWidth_StartOutOfBounds(t *testing.T) {
 	assert.Equal(t, "", field)
 }
 
-func TestRemoveDuplicates(t *testing.T) {
-	lines := []string{
-		"apple",
-		"apple",
-		"banana",
-		"banana",
-		"banana",
-		"cherry",
-		"date",
-		"date",
+func TestSplitFileAndSort_StableAcrossInputs(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "b1\na1\nb2\n")
+	b := writeInput(t, dir, "b.txt", "a2\nb3\na3\n")
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Stable:   true,
+	}
+
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a, b}, 100, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 1)
+	assert.Equal(t, []sorting.Record{
+		{Line: "a1", Seq: 2}, {Line: "a2", Seq: 4}, {Line: "a3", Seq: 6},
+		{Line: "b1", Seq: 1}, {Line: "b2", Seq: 3}, {Line: "b3", Seq: 5},
+	}, readRun(t, chunkFiles[0]))
+}
+
+func TestSplitFileAndSort_ChunksInInputOrder(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "b\na\nd\nc\ne\n")
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 2, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 3)
+	assert.Equal(t, []sorting.Record{{Line: "a", Seq: 2}, {Line: "b", Seq: 1}}, readRun(t, chunkFiles[0]))
+	assert.Equal(t, []sorting.Record{{Line: "c", Seq: 4}, {Line: "d", Seq: 3}}, readRun(t, chunkFiles[1]))
+	assert.Equal(t, []sorting.Record{{Line: "e", Seq: 5}}, readRun(t, chunkFiles[2]))
+}
+
+func TestSortFile_InMemory(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "b\na\nc\na\n")
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		RemoveDuplicates: true,
+	}
+
+	tempDir := t.TempDir()
+	chunkFiles, sorted, err := sorting.SortFile([]string{a}, 100, tempDir, opts)
+	require.NoError(t, err)
+	assert.Empty(t, chunkFiles)
+	require.NotNil(t, sorted)
+	assert.Equal(t, 3, sorted.Len())
+
+	var records []sorting.Record
+	require.NoError(t, sorted.Each(func(line, _ string, seq int64) error {
+		records = append(records, sorting.Record{Line: line, Seq: seq})
+		return nil
+	}))
+	assert.Equal(t, []sorting.Record{{Line: "a", Seq: 2}, {Line: "b", Seq: 1}, {Line: "c", Seq: 3}}, records)
+
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "no chunk file is written")
+}
+
+func TestSortFile_WholeRecordDedupKeepsInputOrder(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "a 3\na 1\na 2\na 1\n")
+	opts := sorting.Options{
+		SortKeys:         []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Stable:           true,
+		RemoveDuplicates: true,
+	}
+
+	_, sorted, err := sorting.SortFile([]string{a}, 100, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.NotNil(t, sorted)
+	var lines []string
+	require.NoError(t, sorted.Each(func(line, _ string, seq int64) error {
+		lines = append(lines, line)
+		return nil
+	}))
+	assert.Equal(t, []string{"a 3", "a 1", "a 2"}, lines)
+}
+
+func TestSortFile_SpillsLargeInput(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "b\na\nd\nc\ne\n")
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}}
+
+	chunkFiles, sorted, err := sorting.SortFile([]string{a}, 2, t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.Nil(t, sorted)
+	assert.Len(t, chunkFiles, 3)
+}
+
+func TestSortFile_InMemoryUpToBudget(t *testing.T) {
+	dir := t.TempDir()
+	var input strings.Builder
+	for i := 1500; i > 0; i-- {
+		fmt.Fprintf(&input, "%08d\n", i)
+	}
+	a := writeInput(t, dir, "a.txt", input.String())
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 8, Asc: true}},
+		Memory:   utils.NewMemoryBudget(3 * 64 << 10),
+	}
+
+	// Larger than a chunk, but within the budget less the share of the chunk
+	// filled while the first one would be written
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 0, t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.Greater(t, len(chunkFiles), 1)
+
+	chunkFiles, sorted, err := sorting.SortFile([]string{a}, 0, t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.Empty(t, chunkFiles)
+	require.NotNil(t, sorted)
+	assert.Equal(t, 1500, sorted.Len())
+}
+
+func readRun(t *testing.T, filename string) []sorting.Record {
+	t.Helper()
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []sorting.Record
+	run := utils.NewRunReader(bufio.NewReader(f))
+	for {
+		line, seq, err := run.Read()
+		if err == io.EOF {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, sorting.Record{Line: line, Seq: seq})
+	}
+}
+
+func TestSplitFileAndSort_Filter(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "02 b\n01 c\n02 a\n01 d\n")
+	filter, err := sorting.ParseFilter("(0,2,EQ,'01')", true)
+	require.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 3, Length: 1, Asc: true}},
+		Filter:   filter,
+	}
+
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 100, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 1)
+	assert.Equal(t, []sorting.Record{{Line: "02 a", Seq: 3}, {Line: "02 b", Seq: 1}}, readRun(t, chunkFiles[0]))
+}
+
+func TestSplitFileAndSort_SkipAndStop(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "header\nd\nc\n")
+	b := writeInput(t, dir, "b.txt", "b\na\n")
+	opts := sorting.Options{
+		SortKeys:    []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		SkipRecords: 1,
+		StopAfter:   3,
+	}
+
+	// The limits count across input files
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a, b}, 100, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 1)
+	assert.Equal(t, []sorting.Record{{Line: "b", Seq: 4}, {Line: "c", Seq: 3}, {Line: "d", Seq: 2}}, readRun(t, chunkFiles[0]))
+}
+
+func TestSplitFileAndSort_StopAfterCountsIncludedRecords(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "01 d\n02 x\n01 c\n02 y\n01 b\n01 a\n")
+	filter, err := sorting.ParseFilter("(0,2,EQ,'01')", false)
+	require.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys:    []sorting.SortKey{{Start: 3, Length: 1, Asc: true}},
+		Filter:      filter,
+		SkipRecords: 1,
+		StopAfter:   2,
+	}
+
+	// Omitted records do not count towards STOPAFT=
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 100, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 1)
+	assert.Equal(t, []sorting.Record{{Line: "01 b", Seq: 5}, {Line: "01 c", Seq: 3}}, readRun(t, chunkFiles[0]))
+}
+
+func TestSplitFileAndSort_LimitKeepsBestRecords(t *testing.T) {
+	dir := t.TempDir()
+	a := writeInput(t, dir, "a.txt", "g\nc\nf\na\ne\nb\nd\n")
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}},
+		Limit:    2,
+	}
+
+	// Full chunks are cut back to the limit instead of being written
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 3, t.TempDir(), opts)
+	require.NoError(t, err)
+	require.Len(t, chunkFiles, 1)
+	assert.Equal(t, []sorting.Record{{Line: "a", Seq: 4}, {Line: "b", Seq: 6}}, readRun(t, chunkFiles[0]))
+}
+
+func TestSplitFileAndSort_ChunksByMemory(t *testing.T) {
+	dir := t.TempDir()
+	var input strings.Builder
+	for i := 5000; i > 0; i-- {
+		fmt.Fprintf(&input, "%08d\n", i)
+	}
+	a := writeInput(t, dir, "a.txt", input.String())
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 8, Asc: true}},
+		Memory:   utils.NewMemoryBudget(3 * 64 << 10),
 	}
-	expected := []string{
-		"apple",
-		"banana",
-		"cherry",
-		"date",
+
+	chunkFiles, err := sorting.SplitFileAndSort([]string{a}, 0, t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.Greater(t, len(chunkFiles), 1, "a chunk is written once it holds its share of the budget")
+
+	records := 0
+	for _, chunkFile := range chunkFiles {
+		run := readRun(t, chunkFile)
+		for i := 1; i < len(run); i++ {
+			assert.Less(t, run[i-1].Line, run[i].Line)
+		}
+		records += len(run)
 	}
-	result := utils.RemoveDuplicates(lines)
-	assert.Equal(t, expected, result)
+	assert.Equal(t, 5000, records)
+}
+
+func TestSplitFileAndSort_CopiedChunksFillHalfTheirShare(t *testing.T) {
+	dir := t.TempDir()
+	var input strings.Builder
+	for i := 5000; i > 0; i-- {
+		fmt.Fprintf(&input, "%08d\n", i)
+	}
+	a := writeInput(t, dir, "a.txt", input.String())
+	opts := sorting.Options{
+		SortKeys: []sorting.SortKey{{Start: 0, Length: 8, Asc: true}},
+		Memory:   utils.NewMemoryBudget(3 * 64 << 10),
+	}
+	plain, err := sorting.SplitFileAndSort([]string{a}, 0, t.TempDir(), opts)
+	require.NoError(t, err)
+
+	// No record is removed, so the copy is as large as the chunk
+	opts.RemoveDuplicates = true
+	copied, err := sorting.SplitFileAndSort([]string{a}, 0, t.TempDir(), opts)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(copied), 2*len(plain)-1, "the copy takes the other half of a share")
 }
@@ -21,10 +21,18 @@ func (s SortKey) String() string {
 	typ := "ascii"
 	if s.Numeric {
 		typ = "numeric"
+	} else if s.EBCDIC() {
+		typ = "ebcdic"
 	}
 	return fmt.Sprintf("start=%d, len=%d, %s, %s", s.Start, s.Length, typ, order)
 }
 
+// EBCDIC reports whether the key's text sorts in the EBCDIC collating
+// sequence (g=ebcdic).
+func (s SortKey) EBCDIC() bool {
+	return strings.EqualFold(s.Collation, "ebcdic")
+}
+
 // SortKeySlice for multiple SortKeys, implements flag.Value
 type SortKeySlice []SortKey
 
@@ -0,0 +1,217 @@
+package sorting
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SumFields lists the numeric fields totalled for records with equal keys
+// (SUM=). Fields are start,length pairs as in sort keys, or columns when the
+// job has a delimiter. With FailOnOverflow a total that does not fit its
+// field fails the job; otherwise the records are written unsummed.
+type SumFields struct {
+	Fields         []SortKey
+	FailOnOverflow bool
+}
+
+// ParseSumFields compiles a SUM= value such as (10,8,20,5).
+func ParseSumFields(expr string) (*SumFields, error) {
+	expr = strings.TrimSpace(expr)
+	expr = strings.TrimSuffix(strings.TrimPrefix(expr, "("), ")")
+	parts := strings.Split(expr, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("SUM fields need a start and a length each")
+	}
+	s := &SumFields{}
+	for i := 0; i < len(parts); i += 2 {
+		start, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid SUM field start %q", parts[i])
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(parts[i+1]))
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid SUM field length %q", parts[i+1])
+		}
+		s.Fields = append(s.Fields, SortKey{Start: start, Length: length})
+	}
+	return s, nil
+}
+
+// errSumOverflow marks a total that does not fit its field.
+var errSumOverflow = fmt.Errorf("total does not fit the field")
+
+// add returns line with every sum field replaced by its total with the same
+// field of other.
+func (s *SumFields) add(line, other, delimiter string) (string, error) {
+	for _, field := range s.Fields {
+		a := ExtractField(line, field, delimiter, false)
+		b := ExtractField(other, field, delimiter, false)
+		total, err := addDecimals(a, b)
+		if err != nil {
+			return "", err
+		}
+		if delimiter != "" {
+			cols := strings.Split(line, delimiter)
+			for len(cols) <= field.Start {
+				cols = append(cols, "")
+			}
+			cols[field.Start] = total
+			line = strings.Join(cols, delimiter)
+			continue
+		}
+		width := field.Length
+		if width == 0 {
+			width = max(len(line)-field.Start, len(total))
+		}
+		if len(total) > width {
+			return "", errSumOverflow
+		}
+		total = padNumber(total, width, strings.HasPrefix(strings.TrimLeft(a, "-+"), "0"))
+		if len(line) < field.Start {
+			line += strings.Repeat(" ", field.Start-len(line))
+		}
+		end := min(field.Start+width, len(line))
+		line = line[:field.Start] + total + line[end:]
+	}
+	return line, nil
+}
+
+// addDecimals adds two decimal numbers exactly. Blank fields count as zero.
+func addDecimals(a, b string) (string, error) {
+	ma, sa, err := parseDecimal(a)
+	if err != nil {
+		return "", err
+	}
+	mb, sb, err := parseDecimal(b)
+	if err != nil {
+		return "", err
+	}
+	scale := max(sa, sb)
+	if ma, err = rescale(ma, scale-sa); err != nil {
+		return "", err
+	}
+	if mb, err = rescale(mb, scale-sb); err != nil {
+		return "", err
+	}
+	if (mb > 0 && ma > math.MaxInt64-mb) || (mb < 0 && ma < math.MinInt64-mb) {
+		return "", errSumOverflow
+	}
+	return formatDecimal(ma+mb, scale), nil
+}
+
+// parseDecimal splits a number into an integer mantissa and a scale.
+func parseDecimal(s string) (int64, int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	scale := 0
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		scale = len(s) - dot - 1
+		s = s[:dot] + s[dot+1:]
+	}
+	m, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return 0, 0, errSumOverflow
+		}
+		return 0, 0, fmt.Errorf("SUM field %q is not numeric", s)
+	}
+	return m, scale, nil
+}
+
+func rescale(m int64, digits int) (int64, error) {
+	for range digits {
+		if m > math.MaxInt64/10 || m < math.MinInt64/10 {
+			return 0, errSumOverflow
+		}
+		m *= 10
+	}
+	return m, nil
+}
+
+func formatDecimal(m int64, scale int) string {
+	sign := ""
+	u := uint64(m)
+	if m < 0 {
+		sign = "-"
+		u = -u
+	}
+	digits := strconv.FormatUint(u, 10)
+	if scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// padNumber right-aligns a total in its field, with leading zeros when the
+// field was zero-padded.
+func padNumber(total string, width int, zeros bool) string {
+	pad := width - len(total)
+	if pad <= 0 {
+		return total
+	}
+	if !zeros {
+		return strings.Repeat(" ", pad) + total
+	}
+	if strings.HasPrefix(total, "-") {
+		return "-" + strings.Repeat("0", pad) + total[1:]
+	}
+	return strings.Repeat("0", pad) + total
+}
+
+// Summer collapses sorted records with equal keys into one record holding
+// the totals of the SUM= fields. The other fields come from the first record
+// in input order, which keeps its record number. When a total overflows, the
+// records so far are written and summing restarts at the next record.
+// Records are passed with their encoded key (Options.Key).
+type Summer struct {
+	opts    Options
+	emit    func(line, key string, seq int64) error
+	last    Record
+	lastKey string
+	hasLast bool
+}
+
+func NewSummer(opts Options, emit func(line, key string, seq int64) error) *Summer {
+	return &Summer{opts: opts, emit: emit}
+}
+
+// Add adds a record to the current total or starts a new one.
+func (s *Summer) Add(line, key string, seq int64) error {
+	o := s.opts
+	if s.hasLast && s.lastKey == key {
+		summed, err := o.Sum.add(s.last.Line, line, o.Delimiter)
+		if err == nil {
+			s.last.Line = summed
+			return nil
+		}
+		if err != errSumOverflow {
+			return fmt.Errorf("record %d: %w", seq, err)
+		}
+		if o.Sum.FailOnOverflow {
+			return fmt.Errorf("record %d: SUM overflow: %w", seq, err)
+		}
+	}
+	if s.hasLast {
+		if err := s.emit(s.last.Line, s.lastKey, s.last.Seq); err != nil {
+			return err
+		}
+	}
+	s.last, s.lastKey, s.hasLast = Record{Line: line, Seq: seq}, key, true
+	return nil
+}
+
+// Flush writes the last total.
+func (s *Summer) Flush() error {
+	if !s.hasLast {
+		return nil
+	}
+	s.hasLast = false
+	return s.emit(s.last.Line, s.lastKey, s.last.Seq)
+}
@@ -0,0 +1,82 @@
+package sorting_test
+
+import (
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/sorting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sumAll(t *testing.T, opts sorting.Options, lines ...string) ([]sorting.Record, error) {
+	t.Helper()
+	var out []sorting.Record
+	summer := sorting.NewSummer(opts, func(line, _ string, seq int64) error {
+		out = append(out, sorting.Record{Line: line, Seq: seq})
+		return nil
+	})
+	for i, line := range lines {
+		if err := summer.Add(line, opts.Key(line), int64(i+1)); err != nil {
+			return out, err
+		}
+	}
+	return out, summer.Flush()
+}
+
+func TestSummer_FixedFields(t *testing.T) {
+	sum, err := sorting.ParseSumFields("(2,5,8,6)")
+	require.NoError(t, err)
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}, Sum: sum}
+
+	out, err := sumAll(t, opts, "a 00010   1.50", "a 00005  -0.25", "b 00001   2.00")
+	require.NoError(t, err)
+	assert.Equal(t, []sorting.Record{
+		{Line: "a 00015   1.25", Seq: 1},
+		{Line: "b 00001   2.00", Seq: 3},
+	}, out)
+}
+
+func TestSummer_DelimitedColumns(t *testing.T) {
+	sum, err := sorting.ParseSumFields("(1,0)")
+	require.NoError(t, err)
+	opts := sorting.Options{
+		SortKeys:  []sorting.SortKey{{Start: 0, Asc: true}},
+		Delimiter: ";",
+		Sum:       sum,
+	}
+
+	out, err := sumAll(t, opts, "x;7;first", "x;35;second")
+	require.NoError(t, err)
+	assert.Equal(t, []sorting.Record{{Line: "x;42;first", Seq: 1}}, out)
+}
+
+func TestSummer_Overflow(t *testing.T) {
+	sum, err := sorting.ParseSumFields("(1,2)")
+	require.NoError(t, err)
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}, Sum: sum}
+
+	// Unsummed: the record that overflows starts a new total
+	out, err := sumAll(t, opts, "a60", "a50", "a10")
+	require.NoError(t, err)
+	assert.Equal(t, []sorting.Record{{Line: "a60", Seq: 1}, {Line: "a60", Seq: 2}}, out)
+
+	sum.FailOnOverflow = true
+	_, err = sumAll(t, opts, "a60", "a50")
+	assert.ErrorContains(t, err, "record 2: SUM overflow")
+}
+
+func TestSummer_NotNumeric(t *testing.T) {
+	sum, err := sorting.ParseSumFields("(1,2)")
+	require.NoError(t, err)
+	opts := sorting.Options{SortKeys: []sorting.SortKey{{Start: 0, Length: 1, Asc: true}}, Sum: sum}
+
+	_, err = sumAll(t, opts, "a10", "axx")
+	assert.ErrorContains(t, err, "not numeric")
+}
+
+func TestParseSumFields_Errors(t *testing.T) {
+	for _, expr := range []string{"(1)", "(a,2)", "(1,-2)"} {
+		_, err := sorting.ParseSumFields(expr)
+		assert.Error(t, err, expr)
+	}
+}
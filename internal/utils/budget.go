@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParseSize parses a size such as 512M, 4G or 1.5GB into bytes. K, M, G and
+// T are powers of 1024; a number without a unit is in bytes.
+func ParseSize(s string) (int64, error) {
+	val := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if n := len(val); n > 0 {
+		if i := strings.IndexByte("KMGT", val[n-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			val = val[:n-1]
+		}
+	}
+	num, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 512M or 4G)", s)
+	}
+	return int64(num * float64(mult)), nil
+}
+
+// inFlightChunks is how many chunks share the budget: one being filled
+// while the others are sorted and written.
+const inFlightChunks = 3
+
+// MemoryBudget is a number of bytes shared by everything a sort holds in
+// memory at the same time: the chunks being filled, sorted and written, and
+// the buffers of the merges. Acquire blocks until enough is free, so work
+// waits instead of going over the budget. A nil budget is unlimited.
+type MemoryBudget struct {
+	total int64
+
+	mu   sync.Mutex
+	free *sync.Cond
+	used int64
+}
+
+func NewMemoryBudget(total int64) *MemoryBudget {
+	b := &MemoryBudget{total: total}
+	b.free = sync.NewCond(&b.mu)
+	return b
+}
+
+// Total returns the size of the budget, or 0 when it is unlimited.
+func (b *MemoryBudget) Total() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.total
+}
+
+// ChunkBytes returns the size at which a chunk is sorted and written, or 0
+// when it is unlimited.
+func (b *MemoryBudget) ChunkBytes() int64 {
+	return b.Total() / inFlightChunks
+}
+
+// Acquire waits until n bytes are free and takes them. More than the whole
+// budget is taken as the whole budget, once nothing else is in use. It
+// returns the bytes taken, to be passed to Release.
+func (b *MemoryBudget) Acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	n = min(n, b.total)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.total {
+		b.free.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// Charge takes n bytes without waiting, also past the size of the budget,
+// for memory that cannot wait; Acquire then waits until it is released.
+// Release returns the bytes.
+func (b *MemoryBudget) Charge(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+// Release returns bytes taken by Acquire or Charge.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.free.Broadcast()
+}
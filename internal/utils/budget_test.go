@@ -0,0 +1,74 @@
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"512M":  512 << 20,
+		"4G":    4 << 30,
+		"4gb":   4 << 30,
+		"64k":   64 << 10,
+		"1.5G":  3 << 29,
+		"1000":  1000,
+		" 2T ":  2 << 40,
+		"100MB": 100 << 20,
+	} {
+		got, err := utils.ParseSize(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "M", "abc", "-1G", "0", "12X"} {
+		_, err := utils.ParseSize(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestMemoryBudget_AcquireWaitsForRelease(t *testing.T) {
+	b := utils.NewMemoryBudget(100)
+	assert.Equal(t, int64(33), b.ChunkBytes())
+	first := b.Acquire(60)
+
+	acquired := make(chan int64)
+	go func() { acquired <- b.Acquire(50) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b.Release(first)
+	assert.Equal(t, int64(50), <-acquired)
+	b.Release(50)
+	assert.Equal(t, int64(100), b.Acquire(500), "more than the budget takes all of it")
+}
+
+func TestMemoryBudget_ChargeGoesPastTheBudget(t *testing.T) {
+	b := utils.NewMemoryBudget(100)
+	b.Charge(150)
+
+	acquired := make(chan int64)
+	go func() { acquired <- b.Acquire(10) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired while charged past the budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b.Release(150)
+	assert.Equal(t, int64(10), <-acquired)
+}
+
+func TestMemoryBudget_NilIsUnlimited(t *testing.T) {
+	var b *utils.MemoryBudget
+	assert.Equal(t, int64(0), b.Acquire(1<<40))
+	b.Charge(1 << 40)
+	b.Release(0)
+	assert.Equal(t, int64(0), b.ChunkBytes())
+}
@@ -1,12 +1,12 @@
 package utils
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/shirou/gopsutil/mem"
 )
@@ -36,79 +36,66 @@ func SafeRemoveAll(path string) {
 	}
 }
 
-// writeChunk writes a chunk of lines to a file.
-func WriteChunk(lines []string, index int, tempDir string) (string, error) {
-	filename := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.txt", index))
-	file, err := os.Create(filename)
-	if err != nil {
-		return "", err
-	}
-	defer SafeClose(file)
+// STDIO as a file name selects standard input (I=-) or standard output (O=-).
+const STDIO = "-"
 
-	writer := bufio.NewWriter(file)
-	newline := GetNewline()
-	for _, line := range lines {
-		_, err := writer.WriteString(line + newline)
-		if err != nil {
-			return "", err
-		}
-	}
-	SafeFlush(writer)
-	return filename, nil
+// nopWriteCloser keeps stdout open when the caller closes its output.
+type nopWriteCloser struct {
+	io.Writer
 }
 
-// calculateChunkSize calculates the chunk size based on the average line size and available memory.
-func CalculateChunkSize(averageLineSize int) int {
-	v, _ := mem.VirtualMemory()
-
-	// Available memory in bytes
-	availableMemory := v.Available
-
-	// Reserve a smaller percentage of the available memory for your process
-	reservedMemory := availableMemory / 20 // 5% of available memory
-
-	// Calculate the chunk size in number of lines
-	chunkSize := int(reservedMemory / uint64(averageLineSize))
-
-	LogInfo("Reserved memory for chunks: %.2f MB", float64(reservedMemory)/1e6)
+func (nopWriteCloser) Close() error { return nil }
 
-	// Ensure the chunk size is not too large or too small
-	if chunkSize > MAX_CHUNK_SIZE {
-		LogWarning("Chunk size too large, reducing to %v records per chunk", MAX_CHUNK_SIZE)
-		chunkSize = MAX_CHUNK_SIZE
-	} else if chunkSize < MIN_CHUNK_SIZE {
-		LogWarning("Chunk size too small, increasing to %v records per chunk to avoid overhead", MIN_CHUNK_SIZE)
-		chunkSize = MIN_CHUNK_SIZE
+// OpenInput opens a file for reading, or returns stdin for STDIO.
+func OpenInput(filename string) (io.ReadCloser, error) {
+	if filename == STDIO {
+		return io.NopCloser(os.Stdin), nil
 	}
-
-	return chunkSize
+	return os.Open(filename)
 }
 
-// estimateAverageLineSize estimates the average line size based on a sample from the file.
-func EstimateAverageLineSize(filename string) int {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 0 // Fallback
+// CreateOutput creates a file for writing, or returns stdout for STDIO.
+func CreateOutput(filename string) (io.WriteCloser, error) {
+	if filename == STDIO {
+		return nopWriteCloser{os.Stdout}, nil
 	}
-	defer SafeClose(file)
+	return os.Create(filename)
+}
 
-	reader := bufio.NewReader(file)
-	var totalSize int
-	var count int
+// RemoveOutput removes an output file that an error left incomplete.
+// Standard output is left alone.
+func RemoveOutput(filename string) {
+	if filename != STDIO {
+		SafeRemove(filename)
+	}
+}
 
-	for count < 100 { // Sample n lines
-		line, err := reader.ReadString('\n')
+// ExpandInputFiles expands glob patterns in the input list. Each pattern must
+// match at least one file; plain names and STDIO are kept as they are.
+func ExpandInputFiles(patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if pattern == STDIO || !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
 		if err != nil {
-			break
+			return nil, fmt.Errorf("invalid input pattern %s: %v", pattern, err)
 		}
-		totalSize += len(line)
-		count++
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no input files match %s", pattern)
+		}
+		files = append(files, matches...)
 	}
+	return files, nil
+}
 
-	if count == 0 {
-		return 0
-	}
-	return totalSize / count
+// ReservedMemory returns the memory a sort may use for its chunks, and
+// later for its merge buffers: 5% of the available memory.
+func ReservedMemory() uint64 {
+	v, _ := mem.VirtualMemory()
+	return v.Available / 20
 }
 
 // GetNewline returns platform-native newline string.
@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/joeymeijers/xmsort/internal/utils"
@@ -14,34 +15,42 @@ func init() {
 	utils.OverrideLogger(log.New(io.Discard, "", 0))
 }
 
-func TestWriteChunk_CreatesFile(t *testing.T) {
-	tmpDir := t.TempDir()
-	lines := []string{"a", "b", "c"}
+func TestOpenInput_File(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "input.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("x\n"), 0644))
 
-	filename, err := utils.WriteChunk(lines, 0, tmpDir)
+	r, err := utils.OpenInput(filename)
 	require.NoError(t, err)
-
-	data, err := os.ReadFile(filename)
+	defer r.Close()
+	data, err := io.ReadAll(r)
 	require.NoError(t, err)
-	require.Equal(t, "a\nb\nc\n", string(data))
+	require.Equal(t, "x\n", string(data))
 }
 
-func TestEstimateAverageLineSize(t *testing.T) {
-	tmpDir := t.TempDir()
-	tmpFile, err := os.CreateTemp(tmpDir, "testfile-*.txt")
+func TestCreateOutput_StdoutIsNotClosed(t *testing.T) {
+	w, err := utils.CreateOutput(utils.STDIO)
 	require.NoError(t, err)
+	require.NoError(t, w.Close())
 
-	content := "short\nmedium line\naveryverylonglinewithtext\n"
-	_, err = tmpFile.WriteString(content)
+	_, err = os.Stdout.Stat()
 	require.NoError(t, err)
-	tmpFile.Close()
-
-	avg := utils.EstimateAverageLineSize(tmpFile.Name())
-	require.True(t, avg > 0)
 }
 
-func TestCalculateChunkSize_ReturnsWithinBounds(t *testing.T) {
-	size := utils.CalculateChunkSize(100)
-	require.GreaterOrEqual(t, size, utils.MIN_CHUNK_SIZE)
-	require.LessOrEqual(t, size, utils.MAX_CHUNK_SIZE)
+func TestExpandInputFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"day2.dat", "day1.dat", "other.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), nil, 0644))
+	}
+
+	files, err := utils.ExpandInputFiles([]string{utils.STDIO, filepath.Join(tmpDir, "day*.dat"), "plain.txt"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		utils.STDIO,
+		filepath.Join(tmpDir, "day1.dat"),
+		filepath.Join(tmpDir, "day2.dat"),
+		"plain.txt",
+	}, files)
+
+	_, err = utils.ExpandInputFiles([]string{filepath.Join(tmpDir, "*.csv")})
+	require.Error(t, err)
 }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package utils
+
+// openFileLimit is unknown here; GetMaxOpenFiles falls back to MAX_OPEN_FILES.
+func openFileLimit() (uint64, bool) {
+	return 0, false
+}
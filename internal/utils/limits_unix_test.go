@@ -0,0 +1,18 @@
+//go:build unix
+
+package utils_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMaxOpenFiles_BelowSoftLimit(t *testing.T) {
+	var rl syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl))
+	assert.Less(t, uint64(utils.GetMaxOpenFiles()), rl.Cur)
+}
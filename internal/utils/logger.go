@@ -5,20 +5,36 @@ import (
 	"io"
 	"log"
 	"os"
+
+	"github.com/cheggaaa/pb/v3"
 )
 
 var logger *log.Logger
 
+// console receives log lines and progress bars. It is stdout by default and
+// is moved to stderr when stdout carries the sorted records.
+var console io.Writer = os.Stdout
+
+// SetConsole redirects log and progress output. Call it before SetupLogging.
+func SetConsole(w io.Writer) {
+	console = w
+}
+
 func SetupLogging() {
 	logFile, err := os.OpenFile("log.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		log.Fatalf("Kan app.log niet openen: %v", err)
 	}
 
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
+	multiWriter := io.MultiWriter(console, logFile)
 	logger = log.New(multiWriter, "XMSORT: ", log.Ldate|log.Ltime)
 }
 
+// StartProgressBar starts a progress bar that writes to the console.
+func StartProgressBar(total int) *pb.ProgressBar {
+	return pb.New(total).SetWriter(console).Start()
+}
+
 func LogInfo(message string, args ...any) {
 	logger.Println("INFO: " + fmt.Sprintf(message, args...))
 }
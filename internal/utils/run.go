@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runMagic starts every run file. Runs are the sorted chunks and intermediate
+// merges; each record is stored as uvarint(seq) uvarint(len) bytes, so
+// records keep their input position and may contain newlines. Record numbers
+// start at 1: a record numbered 0 holds the run index, which ends the run.
+const runMagic = "XMSORT-RUN1\n"
+
+// runIndexMagic starts the run index. The index gives the number of records
+// and the offset of a record about every runIndexSpacing bytes, each as
+// uvarint(offset) uvarint(records before it); the 8 bytes after it are the
+// offset of the index record, so the index is found from the end of the file.
+const (
+	runIndexMagic   = "XMSORT-IDX1\n"
+	runIndexSpacing = 64 << 10
+)
+
+// ErrNoRunIndex is returned by ReadRunIndex for a run written without Close.
+var ErrNoRunIndex = errors.New("run has no index")
+
+// RunIndexEntry locates a record of a run: it starts at Offset and Record
+// records come before it.
+type RunIndexEntry struct {
+	Offset int64
+	Record int64
+}
+
+// RunWriter writes records to a run file.
+type RunWriter struct {
+	w         *bufio.Writer
+	buf       [2 * binary.MaxVarintLen64]byte
+	offset    int64 // bytes written so far
+	records   int64
+	indexedAt int64 // offset of the last record in index
+	index     []byte
+}
+
+// NewRunWriter writes the run header to w and returns a writer for its
+// records. Flush the underlying writer when done.
+func NewRunWriter(w *bufio.Writer) (*RunWriter, error) {
+	if _, err := w.WriteString(runMagic); err != nil {
+		return nil, err
+	}
+	return &RunWriter{w: w, offset: int64(len(runMagic))}, nil
+}
+
+// Write appends a record with its 1-based input record number.
+func (rw *RunWriter) Write(line string, seq int64) error {
+	if seq < 1 {
+		return fmt.Errorf("run record number %d is not positive", seq)
+	}
+	if rw.records == 0 || rw.offset-rw.indexedAt >= runIndexSpacing {
+		rw.index = binary.AppendUvarint(rw.index, uint64(rw.offset))
+		rw.index = binary.AppendUvarint(rw.index, uint64(rw.records))
+		rw.indexedAt = rw.offset
+	}
+	n := binary.PutUvarint(rw.buf[:], uint64(seq))
+	n += binary.PutUvarint(rw.buf[n:], uint64(len(line)))
+	if _, err := rw.w.Write(rw.buf[:n]); err != nil {
+		return err
+	}
+	if _, err := rw.w.WriteString(line); err != nil {
+		return err
+	}
+	rw.offset += int64(n + len(line))
+	rw.records++
+	return nil
+}
+
+// Close ends the run with its index. Flush the underlying writer after.
+func (rw *RunWriter) Close() error {
+	payload := append([]byte(runIndexMagic), binary.AppendUvarint(nil, uint64(rw.records))...)
+	payload = append(payload, rw.index...)
+	record := binary.AppendUvarint([]byte{0}, uint64(len(payload)))
+	record = append(record, payload...)
+	record = binary.BigEndian.AppendUint64(record, uint64(rw.offset))
+	_, err := rw.w.Write(record)
+	return err
+}
+
+// ReadRunIndex reads the index at the end of a run of size bytes and
+// returns its entries, the first at the first record, and the number of
+// records in the run.
+func ReadRunIndex(r io.ReaderAt, size int64) ([]RunIndexEntry, int64, error) {
+	var tail [8]byte
+	if size < int64(len(runMagic)+len(tail)) {
+		return nil, 0, ErrNoRunIndex
+	}
+	if _, err := r.ReadAt(tail[:], size-int64(len(tail))); err != nil {
+		return nil, 0, err
+	}
+	start := int64(binary.BigEndian.Uint64(tail[:]))
+	end := size - int64(len(tail))
+	// An index holds at most two uvarints per runIndexSpacing bytes
+	maxIndex := int64(len(runIndexMagic)) + (start/runIndexSpacing+4)*2*binary.MaxVarintLen64
+	if start < int64(len(runMagic)) || start >= end || end-start > maxIndex {
+		return nil, 0, ErrNoRunIndex
+	}
+	data := make([]byte, end-start)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 2 || data[0] != 0 {
+		return nil, 0, ErrNoRunIndex
+	}
+	length, n := binary.Uvarint(data[1:])
+	data = data[1+max(n, 0):]
+	if n <= 0 || length != uint64(len(data)) || !strings.HasPrefix(string(data), runIndexMagic) {
+		return nil, 0, ErrNoRunIndex
+	}
+	data = data[len(runIndexMagic):]
+
+	records, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, 0, errors.New("run index is corrupt")
+	}
+	data = data[n:]
+	var entries []RunIndexEntry
+	for len(data) > 0 {
+		offset, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, 0, errors.New("run index is corrupt")
+		}
+		record, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return nil, 0, errors.New("run index is corrupt")
+		}
+		data = data[n+m:]
+		entries = append(entries, RunIndexEntry{Offset: int64(offset), Record: int64(record)})
+	}
+	return entries, int64(records), nil
+}
+
+// RunReader reads records from a run file. Framed tells whether the input
+// is a run at all; text inputs are read by the merge's own text reader.
+type RunReader struct {
+	r      *bufio.Reader
+	framed bool
+	offset int64 // bytes of a run consumed so far
+	done   bool  // the run index was reached
+}
+
+func NewRunReader(r *bufio.Reader) *RunReader {
+	head, _ := r.Peek(len(runMagic))
+	framed := string(head) == runMagic
+	rr := &RunReader{r: r, framed: framed}
+	if framed {
+		_, _ = r.Discard(len(runMagic))
+		rr.offset = int64(len(runMagic))
+	}
+	return rr
+}
+
+// NewRunReaderAt reads a run from a record boundary found with Offset; r
+// must be positioned at offset.
+func NewRunReaderAt(r *bufio.Reader, offset int64) *RunReader {
+	return &RunReader{r: r, framed: true, offset: offset}
+}
+
+// Framed reports whether the input is a run rather than plain text.
+func (rr *RunReader) Framed() bool { return rr.framed }
+
+// Offset returns the byte offset of the next record in a run.
+func (rr *RunReader) Offset() int64 { return rr.offset }
+
+// Read returns the next record and its record number, or io.EOF at the end.
+func (rr *RunReader) Read() (string, int64, error) {
+	if !rr.framed {
+		return "", 0, errors.New("input is not a run")
+	}
+	seq, size, err := rr.readHeader()
+	if err != nil {
+		return "", 0, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return "", 0, truncatedRun(err)
+	}
+	rr.offset += int64(size)
+	return string(buf), int64(seq), nil
+}
+
+// Skip passes over the next record of a run without reading it, or returns
+// io.EOF at the end.
+func (rr *RunReader) Skip() error {
+	_, size, err := rr.readHeader()
+	if err != nil {
+		return err
+	}
+	if _, err := rr.r.Discard(int(size)); err != nil {
+		return truncatedRun(err)
+	}
+	rr.offset += int64(size)
+	return nil
+}
+
+// readHeader reads the record number and length of the next run record. The
+// run index counts as the end of the run.
+func (rr *RunReader) readHeader() (uint64, uint64, error) {
+	if rr.done {
+		return 0, 0, io.EOF
+	}
+	seq, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if seq == 0 {
+		rr.done = true
+		return 0, 0, io.EOF
+	}
+	size, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return 0, 0, truncatedRun(err)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	rr.offset += int64(binary.PutUvarint(buf[:], seq) + binary.PutUvarint(buf[:], size))
+	return seq, size, nil
+}
+
+func truncatedRun(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("run file is truncated")
+	}
+	return err
+}
+
+// EstimateRecordCount estimates the number of records in a run file by
+// sampling up to 200 records. Plain text files are estimated by lines;
+// standard input cannot be sampled and counts as empty.
+func EstimateRecordCount(filename string) int {
+	if filename == STDIO {
+		return 0
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 1000000 // fallback
+	}
+	defer SafeClose(file)
+
+	rr := NewRunReader(bufio.NewReader(file))
+	if !rr.framed {
+		return EstimateLineCount(filename)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	var totalSize, records int
+	for records < 200 {
+		line, seq, err := rr.Read()
+		if err != nil {
+			break
+		}
+		totalSize += binary.PutUvarint(buf[:], uint64(seq)) + binary.PutUvarint(buf[:], uint64(len(line))) + len(line)
+		records++
+	}
+	if records == 0 {
+		return 0
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return 1000000
+	}
+	avg := float64(totalSize) / float64(records)
+	return int(float64(fi.Size()-int64(len(runMagic))) / avg)
+}
@@ -0,0 +1,137 @@
+package utils_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joeymeijers/xmsort/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWriterReader_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	require.NoError(t, rw.Write("first", 7))
+	require.NoError(t, rw.Write("with\nnewline", 3))
+	require.NoError(t, rw.Write("", 12))
+	require.NoError(t, w.Flush())
+
+	rr := utils.NewRunReader(bufio.NewReader(&buf))
+	for _, expected := range []struct {
+		line string
+		seq  int64
+	}{{"first", 7}, {"with\nnewline", 3}, {"", 12}} {
+		line, seq, err := rr.Read()
+		require.NoError(t, err)
+		require.Equal(t, expected.line, line)
+		require.Equal(t, expected.seq, seq)
+	}
+	_, _, err = rr.Read()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestRunWriter_Index(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	line := strings.Repeat("x", 1000)
+	for i := 1; i <= 200; i++ {
+		require.NoError(t, rw.Write(line, int64(i)))
+	}
+	require.NoError(t, rw.Close())
+	require.NoError(t, w.Flush())
+
+	data := buf.Bytes()
+	entries, records, err := utils.ReadRunIndex(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, int64(200), records)
+	require.Greater(t, len(entries), 2)
+	require.Equal(t, int64(0), entries[0].Record)
+	for _, e := range entries {
+		at := utils.NewRunReaderAt(bufio.NewReader(bytes.NewReader(data[e.Offset:])), e.Offset)
+		_, seq, err := at.Read()
+		require.NoError(t, err)
+		require.Equal(t, e.Record+1, seq)
+	}
+
+	rr := utils.NewRunReader(bufio.NewReader(bytes.NewReader(data)))
+	n := 0
+	for ; ; n++ {
+		if _, _, err := rr.Read(); err == io.EOF {
+			break
+		}
+	}
+	require.Equal(t, 200, n, "the index ends the records")
+	require.Equal(t, io.EOF, rr.Skip())
+
+	_, _, err = utils.ReadRunIndex(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1))
+	require.Equal(t, utils.ErrNoRunIndex, err)
+}
+
+func TestRunReader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	require.NoError(t, rw.Write("record", 1))
+	require.NoError(t, w.Flush())
+
+	data := buf.Bytes()[:buf.Len()-2]
+	rr := utils.NewRunReader(bufio.NewReader(bytes.NewReader(data)))
+	_, _, err = rr.Read()
+	require.EqualError(t, err, "run file is truncated")
+}
+
+func TestEstimateRecordCount_Run(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "chunk.run")
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	w := bufio.NewWriter(f)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	for i := 1; i <= 50; i++ {
+		require.NoError(t, rw.Write("record", int64(i)))
+	}
+	require.NoError(t, w.Flush())
+	require.NoError(t, f.Close())
+
+	require.Equal(t, 50, utils.EstimateRecordCount(filename))
+}
+
+func TestRunReader_OffsetSkipAndReadAt(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	rw, err := utils.NewRunWriter(w)
+	require.NoError(t, err)
+	for i, line := range []string{"one", strings.Repeat("x", 300), "three", "four"} {
+		require.NoError(t, rw.Write(line, int64(i+1)))
+	}
+	require.NoError(t, w.Flush())
+
+	rr := utils.NewRunReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	require.True(t, rr.Framed())
+	require.NoError(t, rr.Skip())
+	require.NoError(t, rr.Skip())
+	offset := rr.Offset()
+	line, seq, err := rr.Read()
+	require.NoError(t, err)
+	require.Equal(t, "three", line)
+	require.Equal(t, int64(3), seq)
+
+	at := utils.NewRunReaderAt(bufio.NewReader(bytes.NewReader(buf.Bytes()[offset:])), offset)
+	for _, want := range []string{"three", "four"} {
+		line, _, err := at.Read()
+		require.NoError(t, err)
+		require.Equal(t, want, line)
+	}
+	require.Equal(t, io.EOF, at.Skip())
+	require.Equal(t, int64(buf.Len()), at.Offset())
+}
@@ -5,10 +5,15 @@ import (
 	"os"
 )
 
-const MAX_CHUNK_SIZE = 1_000_000
-const MIN_CHUNK_SIZE = 5_000
 const MAX_OPEN_FILES = 128 // Safe limit for Windows and other platforms
 
+// openFilesReserve is kept free of the open file limit for the inputs,
+// output, log and duplicates files that stay open during merges.
+const openFilesReserve = 32
+
+// maxOpenFilesCap bounds the limit when RLIMIT_NOFILE is unlimited.
+const maxOpenFilesCap = 1 << 16
+
 // estimateLineCount estimates the number of lines in a file by sampling up to 200 lines.
 func EstimateLineCount(filename string) int {
 	file, err := os.Open(filename)
@@ -40,21 +45,22 @@ func EstimateLineCount(filename string) int {
 	return int(float64(fi.Size()) / avg)
 }
 
-// getMaxOpenFiles returns a safe number of files that can be opened concurrently.
+// getMaxOpenFiles returns a safe number of files that can be opened concurrently:
+// the RLIMIT_NOFILE soft limit less a reserve, or MAX_OPEN_FILES where the
+// limit is unknown.
 func GetMaxOpenFiles() int {
-	return MAX_OPEN_FILES
+	limit, ok := openFileLimit()
+	if !ok {
+		return MAX_OPEN_FILES
+	}
+	return maxOpenFiles(limit)
 }
 
-func RemoveDuplicates(lines []string) []string {
-	if len(lines) == 0 {
-		return lines
-	}
-	result := []string{lines[0]}
-	for i := 1; i < len(lines); i++ {
-		if lines[i] != lines[i-1] {
-			result = append(result, lines[i])
-		}
+func maxOpenFiles(limit uint64) int {
+	if limit > maxOpenFilesCap {
+		return maxOpenFilesCap - openFilesReserve
 	}
-	return result
+	// Half of a small limit, so a few files are always left
+	return max(int(limit)-openFilesReserve, int(limit)/2, 1)
 }
 
@@ -39,5 +39,5 @@ func TestEstimateLineCount_EmptyFile(t *testing.T) {
 }
 
 func TestGetMaxOpenFiles(t *testing.T) {
-	assert.Equal(t, 128, utils.GetMaxOpenFiles())
+	assert.Positive(t, utils.GetMaxOpenFiles())
 }